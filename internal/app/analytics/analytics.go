@@ -0,0 +1,167 @@
+// Package analytics records the clicks on short links off the request path.
+package analytics
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app"
+	"github.com/JamesDeGreese/ya_golang/internal/app/storage"
+)
+
+// Event is a redirect as seen by GetHandler. IP is hashed before the event
+// reaches the storage.
+type Event struct {
+	LinkID    string
+	At        time.Time
+	Referrer  string
+	UserAgent string
+	IP        string
+}
+
+// Recorder buffers events and writes them to the storage in batches from a
+// single background goroutine. When the buffer is full new events are
+// dropped rather than slowing down the redirects. A nil *Recorder records
+// nothing.
+type Recorder struct {
+	storage   storage.Repository
+	salt      string
+	batchSize int
+	interval  time.Duration
+
+	mu      sync.RWMutex
+	closed  bool
+	events  chan Event
+	done    chan struct{}
+	dropped uint64
+}
+
+func NewRecorder(s storage.Repository, c app.Config) *Recorder {
+	batchSize := c.ClickBatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	interval := c.ClickFlushInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	// Record never blocks, so an unbuffered channel would drop every click
+	// the run loop is not waiting for at that very moment.
+	bufferSize := c.ClickBufferSize
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+
+	r := &Recorder{
+		storage:   s,
+		salt:      c.AppKey,
+		batchSize: batchSize,
+		interval:  interval,
+		events:    make(chan Event, bufferSize),
+		done:      make(chan struct{}),
+	}
+	go r.run()
+
+	return r
+}
+
+// Record queues e without blocking.
+func (r *Recorder) Record(e Event) {
+	if r == nil {
+		return
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return
+	}
+
+	select {
+	case r.events <- e:
+	default:
+		if n := atomic.AddUint64(&r.dropped, 1); n&(n-1) == 0 {
+			log.Printf("analytics: buffer is full, %d clicks dropped so far", n)
+		}
+	}
+}
+
+// Dropped returns the number of events dropped because the buffer was full.
+func (r *Recorder) Dropped() uint64 {
+	if r == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&r.dropped)
+}
+
+// Close stops accepting events and returns once the buffered ones are
+// written.
+func (r *Recorder) Close() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.events)
+	}
+	r.mu.Unlock()
+
+	<-r.done
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+
+	batch := make([]storage.Click, 0, r.batchSize)
+	for {
+		select {
+		case e, ok := <-r.events:
+			if !ok {
+				r.flush(batch)
+				return
+			}
+			batch = append(batch, storage.Click{
+				LinkID:    e.LinkID,
+				At:        e.At,
+				Referrer:  e.Referrer,
+				UserAgent: e.UserAgent,
+				IPHash:    HashIP(e.IP, r.salt),
+			})
+			if len(batch) >= r.batchSize {
+				r.flush(batch)
+				batch = batch[:0]
+			}
+		case <-t.C:
+			r.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (r *Recorder) flush(batch []storage.Click) {
+	if len(batch) == 0 {
+		return
+	}
+
+	err := r.storage.AddClicks(context.Background(), batch)
+	if err != nil {
+		log.Printf("analytics: %d clicks lost: %v", len(batch), err)
+	}
+}
+
+// HashIP returns the salted SHA-256 hash of ip, so that clicks from the
+// same address can be told apart without storing the address.
+func HashIP(ip string, salt string) string {
+	sum := sha256.Sum256([]byte(salt + "\x00" + ip))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,59 @@
+package analytics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app"
+	"github.com/JamesDeGreese/ya_golang/internal/app/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorderFlushesOnClose(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemoryStorage()
+	require.NoError(t, s.AddURL(ctx, storage.ShortLink{ID: "a", OriginalURL: "https://example.org/a"}))
+
+	r := NewRecorder(s, app.Config{ClickBufferSize: 10, ClickBatchSize: 3, ClickFlushInterval: time.Hour})
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		r.Record(Event{LinkID: "a", At: now, IP: "127.0.0.1"})
+	}
+	r.Close()
+	r.Record(Event{LinkID: "a", At: now})
+
+	stats, err := s.GetClickStats(ctx, "a", now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), stats.Total)
+}
+
+func TestRecorderBuffersAtLeastOneEvent(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		r := NewRecorder(storage.NewMemoryStorage(), app.Config{ClickBufferSize: size})
+		assert.Equal(t, 1, cap(r.events), size)
+		r.Close()
+	}
+}
+
+func TestRecorderDropsWhenFull(t *testing.T) {
+	r := &Recorder{events: make(chan Event, 1)}
+	r.Record(Event{LinkID: "a"})
+	r.Record(Event{LinkID: "a"})
+	assert.Equal(t, uint64(1), r.Dropped())
+}
+
+func TestNilRecorder(t *testing.T) {
+	var r *Recorder
+	r.Record(Event{LinkID: "a"})
+	r.Close()
+	assert.Zero(t, r.Dropped())
+}
+
+func TestHashIP(t *testing.T) {
+	assert.Equal(t, HashIP("127.0.0.1", "salt"), HashIP("127.0.0.1", "salt"))
+	assert.NotEqual(t, HashIP("127.0.0.1", "salt"), HashIP("127.0.0.2", "salt"))
+	assert.NotEqual(t, HashIP("127.0.0.1", "salt"), HashIP("127.0.0.1", "pepper"))
+	assert.NotContains(t, HashIP("127.0.0.1", "salt"), "127.0.0.1")
+}
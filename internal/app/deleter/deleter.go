@@ -0,0 +1,230 @@
+// Package deleter deletes the links of users off the request path.
+package deleter
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app"
+	"github.com/JamesDeGreese/ya_golang/internal/app/storage"
+)
+
+var (
+	// ErrQueueFull is returned by Enqueue when the queue holds as many
+	// requests as it may.
+	ErrQueueFull = errors.New("deletion queue is full")
+	// ErrQueueClosed is returned by Enqueue after Close.
+	ErrQueueClosed = errors.New("deletion queue is closed")
+)
+
+// Request asks to delete the links IDs owned by UserID.
+type Request struct {
+	UserID string
+	IDs    []string
+}
+
+// Queue holds deletion requests in a bounded buffer served by a pool of
+// workers. Every worker gathers the IDs of many requests and deletes them
+// with one storage call per user once it has a full batch or the flush
+// interval passes. Calls failing with a timeout or an unavailable storage
+// are retried with an exponential backoff. Every request is tracked as a
+// Job.
+type Queue struct {
+	storage   storage.Repository
+	batchSize int
+	interval  time.Duration
+	retries   int
+	backoff   time.Duration
+	jobs      *jobs
+
+	mu       sync.RWMutex
+	closed   bool
+	requests chan *job
+	workers  sync.WaitGroup
+}
+
+func NewQueue(s storage.Repository, c app.Config) *Queue {
+	workers := c.DeleteWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	batchSize := c.DeleteBatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	size := c.DeleteQueueSize
+	if size < 1 {
+		size = 1
+	}
+	jobTTL := c.DeleteJobTTL
+	if jobTTL <= 0 {
+		jobTTL = time.Hour
+	}
+	interval := c.DeleteFlushInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	q := &Queue{
+		storage:   s,
+		batchSize: batchSize,
+		interval:  interval,
+		retries:   c.DeleteRetries,
+		backoff:   c.DeleteRetryBackoff,
+		jobs:      newJobs(jobTTL),
+		requests:  make(chan *job, size),
+	}
+	q.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.run()
+	}
+
+	return q
+}
+
+// Enqueue queues r without blocking and returns the ID of its Job.
+func (q *Queue) Enqueue(r Request) (string, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return "", ErrQueueClosed
+	}
+
+	j := newJob(r)
+	if j.pending > 0 {
+		select {
+		case q.requests <- j:
+		default:
+			return "", ErrQueueFull
+		}
+	}
+	q.jobs.add(j)
+
+	return j.ID, nil
+}
+
+// Job returns the job ID, if it is known.
+func (q *Queue) Job(ID string) (Job, bool) {
+	return q.jobs.get(ID)
+}
+
+// Depth returns the number of requests waiting for a worker.
+func (q *Queue) Depth() int {
+	return len(q.requests)
+}
+
+// Capacity returns the number of requests the queue may hold.
+func (q *Queue) Capacity() int {
+	return cap(q.requests)
+}
+
+// Close stops accepting requests and waits until the queued ones are
+// done, or until ctx is done.
+func (q *Queue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.requests)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *Queue) run() {
+	defer q.workers.Done()
+
+	t := time.NewTicker(q.interval)
+	defer t.Stop()
+
+	// batch holds the jobs of each user.
+	batch := make(map[string][]*job)
+	size := 0
+	for {
+		select {
+		case j, ok := <-q.requests:
+			if !ok {
+				q.flush(batch)
+				return
+			}
+			batch[j.UserID] = append(batch[j.UserID], j)
+			size += len(j.IDs)
+			if size >= q.batchSize {
+				q.flush(batch)
+				batch, size = make(map[string][]*job), 0
+			}
+		case <-t.C:
+			if size > 0 {
+				q.flush(batch)
+				batch, size = make(map[string][]*job), 0
+			}
+		}
+	}
+}
+
+func (q *Queue) flush(batch map[string][]*job) {
+	for userID, js := range batch {
+		var IDs []string
+		seen := make(map[string]struct{})
+		for _, j := range js {
+			for _, ID := range j.IDs {
+				if _, ok := seen[ID]; !ok {
+					seen[ID] = struct{}{}
+					IDs = append(IDs, ID)
+				}
+			}
+		}
+
+		deleted, err := q.delete(userID, IDs)
+		if err != nil {
+			log.Printf("deleter: %d links of %s left undeleted: %v", len(IDs), userID, err)
+		}
+		owned := make(map[string]struct{}, len(deleted))
+		for _, ID := range deleted {
+			owned[ID] = struct{}{}
+		}
+		for _, j := range js {
+			for _, ID := range j.IDs {
+				status := StatusSkipped
+				if err != nil {
+					status = StatusFailed
+				} else if _, ok := owned[ID]; ok {
+					status = StatusCompleted
+				}
+				q.jobs.finish(j, ID, status)
+			}
+		}
+	}
+}
+
+func (q *Queue) delete(userID string, IDs []string) ([]string, error) {
+	backoff := q.backoff
+	for attempt := 0; ; attempt++ {
+		deleted, err := q.storage.DeleteUserURLs(context.Background(), IDs, userID)
+		if err == nil || !isTransient(err) || attempt >= q.retries {
+			return deleted, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func isTransient(err error) bool {
+	var ote *storage.OperationTimeoutError
+	var sue *storage.StorageUnavailableError
+	return errors.As(err, &ote) || errors.As(err, &sue)
+}
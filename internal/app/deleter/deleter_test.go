@@ -0,0 +1,168 @@
+package deleter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app"
+	"github.com/JamesDeGreese/ya_golang/internal/app/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingStorage records the DeleteUserURLs calls and fails the first
+// failures of them with err.
+type recordingStorage struct {
+	*storage.MemoryStorage
+
+	mu       sync.Mutex
+	calls    []Request
+	failures int
+	err      error
+}
+
+func (s *recordingStorage) DeleteUserURLs(ctx context.Context, IDs []string, userID string) ([]string, error) {
+	s.mu.Lock()
+	s.calls = append(s.calls, Request{UserID: userID, IDs: IDs})
+	if s.failures > 0 {
+		s.failures--
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	s.mu.Unlock()
+
+	return s.MemoryStorage.DeleteUserURLs(ctx, IDs, userID)
+}
+
+func TestQueueBatchesRequests(t *testing.T) {
+	s := &recordingStorage{MemoryStorage: storage.NewMemoryStorage()}
+	q := NewQueue(s, app.Config{DeleteQueueSize: 10, DeleteWorkers: 1, DeleteBatchSize: 100, DeleteFlushInterval: time.Hour})
+
+	for _, r := range []Request{
+		{UserID: "u1", IDs: []string{"a", "b"}},
+		{UserID: "u2", IDs: []string{"c"}},
+		{UserID: "u1", IDs: []string{"d", "a"}},
+	} {
+		_, err := q.Enqueue(r)
+		require.NoError(t, err)
+	}
+	require.NoError(t, q.Close(context.Background()))
+
+	assert.ElementsMatch(t, []Request{
+		{UserID: "u1", IDs: []string{"a", "b", "d"}},
+		{UserID: "u2", IDs: []string{"c"}},
+	}, s.calls)
+	_, err := q.Enqueue(Request{UserID: "u1", IDs: []string{"e"}})
+	assert.ErrorIs(t, err, ErrQueueClosed)
+}
+
+func TestQueueFlushesOnInterval(t *testing.T) {
+	s := &recordingStorage{MemoryStorage: storage.NewMemoryStorage()}
+	q := NewQueue(s, app.Config{DeleteQueueSize: 10, DeleteWorkers: 1, DeleteBatchSize: 100, DeleteFlushInterval: 10 * time.Millisecond})
+	defer q.Close(context.Background())
+
+	_, err := q.Enqueue(Request{UserID: "u1", IDs: []string{"a"}})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.calls) == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestQueueRetriesTransientFailures(t *testing.T) {
+	ctx := context.Background()
+	s := &recordingStorage{
+		MemoryStorage: storage.NewMemoryStorage(),
+		failures:      2,
+		err:           &storage.StorageUnavailableError{Err: errors.New("pool is busy")},
+	}
+	require.NoError(t, s.AddURL(ctx, storage.ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"}))
+	q := NewQueue(s, app.Config{DeleteWorkers: 1, DeleteBatchSize: 1, DeleteRetries: 2, DeleteRetryBackoff: time.Millisecond})
+
+	_, err := q.Enqueue(Request{UserID: "u1", IDs: []string{"a"}})
+	require.NoError(t, err)
+	require.NoError(t, q.Close(ctx))
+
+	assert.Len(t, s.calls, 3)
+	_, err = s.GetURLByID(ctx, "a")
+	var rde *storage.RecordSoftDeletedError
+	assert.ErrorAs(t, err, &rde)
+}
+
+func TestQueueDoesNotRetryPermanentFailures(t *testing.T) {
+	s := &recordingStorage{
+		MemoryStorage: storage.NewMemoryStorage(),
+		failures:      1,
+		err:           errors.New("broken"),
+	}
+	q := NewQueue(s, app.Config{DeleteWorkers: 1, DeleteBatchSize: 1, DeleteRetries: 2, DeleteRetryBackoff: time.Millisecond})
+
+	jobID, err := q.Enqueue(Request{UserID: "u1", IDs: []string{"a"}})
+	require.NoError(t, err)
+	require.NoError(t, q.Close(context.Background()))
+
+	assert.Len(t, s.calls, 1)
+	job, ok := q.Job(jobID)
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"a": StatusFailed}, job.Statuses)
+}
+
+func TestQueueRejectsWhenFull(t *testing.T) {
+	q := &Queue{requests: make(chan *job, 1), jobs: newJobs(time.Hour)}
+	_, err := q.Enqueue(Request{UserID: "u1", IDs: []string{"a"}})
+	require.NoError(t, err)
+	_, err = q.Enqueue(Request{UserID: "u1", IDs: []string{"b"}})
+	assert.ErrorIs(t, err, ErrQueueFull)
+	assert.Equal(t, 1, q.Depth())
+	assert.Equal(t, 1, q.Capacity())
+	assert.Len(t, q.jobs.byID, 1)
+}
+
+func TestQueueTracksJobs(t *testing.T) {
+	ctx := context.Background()
+	s := &recordingStorage{MemoryStorage: storage.NewMemoryStorage()}
+	require.NoError(t, s.AddURL(ctx, storage.ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"}))
+	require.NoError(t, s.AddURL(ctx, storage.ShortLink{ID: "b", OriginalURL: "https://example.org/b", UserID: "u2"}))
+	q := NewQueue(s, app.Config{DeleteQueueSize: 10, DeleteWorkers: 1, DeleteBatchSize: 100, DeleteFlushInterval: time.Hour, DeleteJobTTL: time.Hour})
+
+	jobID, err := q.Enqueue(Request{UserID: "u1", IDs: []string{"a", "b", "missing", "a"}})
+	require.NoError(t, err)
+
+	job, ok := q.Job(jobID)
+	require.True(t, ok)
+	assert.Equal(t, "u1", job.UserID)
+	assert.Equal(t, []string{"a", "b", "missing"}, job.IDs)
+	assert.Equal(t, 3, job.Counts()[StatusPending])
+
+	require.NoError(t, q.Close(ctx))
+
+	job, ok = q.Job(jobID)
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"a": StatusCompleted, "b": StatusSkipped, "missing": StatusSkipped}, job.Statuses)
+	assert.Equal(t, map[string]int{StatusPending: 0, StatusCompleted: 1, StatusFailed: 0, StatusSkipped: 2}, job.Counts())
+
+	_, ok = q.Job("unknown")
+	assert.False(t, ok)
+}
+
+func TestJobsExpireAfterTTL(t *testing.T) {
+	js := newJobs(time.Minute)
+	j := newJob(Request{UserID: "u1", IDs: []string{"a"}})
+	js.add(j)
+	js.finish(j, "a", StatusCompleted)
+
+	_, ok := js.get(j.ID)
+	assert.True(t, ok)
+
+	j.finishedAt = time.Now().Add(-2 * time.Minute)
+	_, ok = js.get(j.ID)
+	assert.False(t, ok)
+
+	js.lastPrune = time.Time{}
+	js.add(newJob(Request{UserID: "u1", IDs: []string{"b"}}))
+	assert.NotContains(t, js.byID, j.ID)
+}
@@ -0,0 +1,130 @@
+package deleter
+
+import (
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Statuses of the IDs of a Job.
+const (
+	StatusPending   = "pending"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	// StatusSkipped is an ID of no link of the job's user.
+	StatusSkipped = "skipped"
+)
+
+// jobsPruneInterval is how often the finished jobs are checked for expiry.
+const jobsPruneInterval = time.Minute
+
+// Job is the state of an enqueued Request: the status of each of its IDs,
+// listed once each in the order of the request.
+type Job struct {
+	ID       string
+	UserID   string
+	IDs      []string
+	Statuses map[string]string
+}
+
+// Counts returns the number of IDs of the job in each status.
+func (j Job) Counts() map[string]int {
+	counts := map[string]int{StatusPending: 0, StatusCompleted: 0, StatusFailed: 0, StatusSkipped: 0}
+	for _, status := range j.Statuses {
+		counts[status]++
+	}
+	return counts
+}
+
+type job struct {
+	Job
+	pending    int
+	finishedAt time.Time
+}
+
+// jobs keeps the jobs of a Queue until ttl after they finish. The jobs
+// live in memory only, so a restart forgets them.
+type jobs struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	byID      map[string]*job
+	lastPrune time.Time
+}
+
+func newJobs(ttl time.Duration) *jobs {
+	return &jobs{ttl: ttl, byID: make(map[string]*job)}
+}
+
+func newJob(r Request) *job {
+	j := &job{Job: Job{
+		ID:       uuid.NewV4().String(),
+		UserID:   r.UserID,
+		Statuses: make(map[string]string, len(r.IDs)),
+	}}
+	for _, ID := range r.IDs {
+		if _, ok := j.Statuses[ID]; ok {
+			continue
+		}
+		j.IDs = append(j.IDs, ID)
+		j.Statuses[ID] = StatusPending
+	}
+	j.pending = len(j.IDs)
+	if j.pending == 0 {
+		j.finishedAt = time.Now()
+	}
+
+	return j
+}
+
+func (js *jobs) add(j *job) {
+	now := time.Now()
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	js.byID[j.ID] = j
+	if now.Sub(js.lastPrune) < jobsPruneInterval {
+		return
+	}
+	js.lastPrune = now
+	for ID, j := range js.byID {
+		if j.pending == 0 && now.Sub(j.finishedAt) > js.ttl {
+			delete(js.byID, ID)
+		}
+	}
+}
+
+// get returns a copy of the job ID.
+func (js *jobs) get(ID string) (Job, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	j, ok := js.byID[ID]
+	if !ok || j.pending == 0 && time.Since(j.finishedAt) > js.ttl {
+		return Job{}, false
+	}
+
+	res := j.Job
+	res.Statuses = make(map[string]string, len(j.Statuses))
+	for ID, status := range j.Statuses {
+		res.Statuses[ID] = status
+	}
+	return res, true
+}
+
+// finish sets the status of the pending ID of j.
+func (js *jobs) finish(j *job, ID string, status string) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if j.Statuses[ID] != StatusPending {
+		return
+	}
+	j.Statuses[ID] = status
+	j.pending--
+	if j.pending == 0 {
+		j.finishedAt = time.Now()
+	}
+}
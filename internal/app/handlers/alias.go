@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	minAliasLength = 3
+	maxAliasLength = 32
+)
+
+// reservedAliases are the first path segments of the routes registered by
+// router.SetupRouter. A link stored under one of them could not be reached
+// or would shadow the route.
+var reservedAliases = map[string]struct{}{
+	"api":     {},
+	"healthz": {},
+	"ping":    {},
+	"readyz":  {},
+}
+
+func isReserved(ID string) bool {
+	_, ok := reservedAliases[strings.ToLower(ID)]
+	return ok
+}
+
+// validateAlias checks a short ID chosen by a client: 3 to 32 ASCII letters,
+// digits, '-' or '_', and none of the reserved words.
+func validateAlias(alias string) error {
+	if len(alias) < minAliasLength || len(alias) > maxAliasLength {
+		return fmt.Errorf("alias must be %d to %d characters long", minAliasLength, maxAliasLength)
+	}
+	for _, r := range alias {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("alias may only contain letters, digits, '-' and '_'")
+		}
+	}
+	if isReserved(alias) {
+		return fmt.Errorf("alias %q is reserved", alias)
+	}
+
+	return nil
+}
@@ -1,21 +1,59 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/JamesDeGreese/ya_golang/internal/app"
+	"github.com/JamesDeGreese/ya_golang/internal/app/analytics"
+	"github.com/JamesDeGreese/ya_golang/internal/app/deleter"
+	"github.com/JamesDeGreese/ya_golang/internal/app/shortid"
 	"github.com/JamesDeGreese/ya_golang/internal/app/storage"
 	"github.com/gin-gonic/gin"
-	uuid "github.com/satori/go.uuid"
 )
 
 type Handler struct {
 	Config  app.Config
 	Storage storage.Repository
+	IDs     shortid.IDGenerator
+	Clicks  *analytics.Recorder
+	// Deletions runs the deletions requested through UserURLsDeleteHandler.
+	Deletions *deleter.Queue
+
+	// TrustedSubnet holds the parsed Config.TrustedSubnet, nil if unset.
+	TrustedSubnet *net.IPNet
+}
+
+// NewHandler returns a Handler using the short ID generator selected by c.
+func NewHandler(ctx context.Context, c app.Config, s storage.Repository) (Handler, error) {
+	ids, err := shortid.New(ctx, c, s)
+	if err != nil {
+		return Handler{}, err
+	}
+
+	var subnet *net.IPNet
+	if c.TrustedSubnet != "" {
+		_, subnet, err = net.ParseCIDR(c.TrustedSubnet)
+		if err != nil {
+			return Handler{}, fmt.Errorf("trusted subnet: %w", err)
+		}
+	}
+
+	return Handler{
+		Config:        c,
+		Storage:       s,
+		IDs:           ids,
+		Deletions:     deleter.NewQueue(s, c),
+		TrustedSubnet: subnet,
+	}, nil
 }
 
 func (h Handler) GetHandler(c *gin.Context) {
@@ -26,16 +64,29 @@ func (h Handler) GetHandler(c *gin.Context) {
 		return
 	}
 
-	fullURL, err := h.Storage.GetURLByID(ID)
-	if fullURL == "" || err != nil {
+	fullURL, err := h.Storage.GetURLByID(c.Request.Context(), ID)
+	if err != nil {
 		var rde *storage.RecordSoftDeletedError
-		if errors.As(err, &rde) {
+		var ree *storage.RecordExpiredError
+		if errors.As(err, &rde) || errors.As(err, &ree) {
 			c.String(http.StatusGone, "")
+			return
 		}
+		c.String(storageErrorStatus(err), "")
+		return
+	}
+	if fullURL == "" {
 		c.String(http.StatusNotFound, "")
 		return
 	}
 
+	h.Clicks.Record(analytics.Event{
+		LinkID:    ID,
+		At:        time.Now(),
+		Referrer:  c.Request.Referer(),
+		UserAgent: c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+	})
 	c.Redirect(http.StatusTemporaryRedirect, fullURL)
 }
 
@@ -46,7 +97,7 @@ func (h Handler) PostHandler(c *gin.Context) {
 		return
 	}
 
-	urlID, err := storeNewLink(h, c, string(body))
+	urlID, err := storeNewLink(h, c, storage.ShortLink{OriginalURL: string(body)})
 	short := fmt.Sprintf("%s/%s", h.Config.BaseURL, urlID)
 	if err != nil {
 		var rde *storage.RecordDuplicateError
@@ -54,7 +105,7 @@ func (h Handler) PostHandler(c *gin.Context) {
 			c.String(http.StatusConflict, "%s", short)
 			return
 		}
-		c.String(http.StatusInternalServerError, "")
+		c.String(storageErrorStatus(err), "")
 		return
 	}
 
@@ -70,7 +121,19 @@ func (h Handler) PostHandlerJSON(c *gin.Context) {
 		return
 	}
 
-	urlID, err := storeNewLink(h, c, req.URL)
+	expiresAt, err := linkExpiry(req.ExpiresAt, req.TTL, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	link := storage.ShortLink{OriginalURL: req.URL, ExpiresAt: expiresAt}
+
+	if req.Alias != "" {
+		h.storeAlias(c, req.Alias, link)
+		return
+	}
+
+	urlID, err := storeNewLink(h, c, link)
 	res := PostJSONResponse{Result: fmt.Sprintf("%s/%s", h.Config.BaseURL, urlID)}
 	if err != nil {
 		var rde *storage.RecordDuplicateError
@@ -78,13 +141,62 @@ func (h Handler) PostHandlerJSON(c *gin.Context) {
 			c.JSON(http.StatusConflict, res)
 			return
 		}
-		c.String(http.StatusInternalServerError, "")
+		c.String(storageErrorStatus(err), "")
 		return
 	}
 
 	c.JSON(http.StatusCreated, res)
 }
 
+// storeAlias stores link under the alias chosen by the client. The alias is
+// refused with 409 when it is taken, unless it already points to the same
+// URL for the same user.
+func (h Handler) storeAlias(c *gin.Context, alias string, link storage.ShortLink) {
+	err := validateAlias(alias)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	userID := c.GetString("user-id")
+	res := PostJSONResponse{Result: fmt.Sprintf("%s/%s", h.Config.BaseURL, alias)}
+
+	link.ID, link.UserID = alias, userID
+	err = h.Storage.AddURL(c.Request.Context(), link)
+	if err == nil {
+		c.JSON(http.StatusCreated, res)
+		return
+	}
+
+	var ice *storage.RecordIDCollisionError
+	if errors.As(err, &ice) {
+		taken, err := h.Storage.GetLinkByID(c.Request.Context(), alias)
+		if err != nil {
+			c.String(storageErrorStatus(err), "")
+			return
+		}
+		if taken.UserID == userID && taken.OriginalURL == link.OriginalURL {
+			c.JSON(http.StatusConflict, res)
+			return
+		}
+		c.JSON(http.StatusConflict, ErrorResponse{Error: fmt.Sprintf("alias %q is taken", alias)})
+		return
+	}
+
+	var rde *storage.RecordDuplicateError
+	if errors.As(err, &rde) {
+		ID, err := h.Storage.GetURLByOriginalURL(c.Request.Context(), link.OriginalURL, userID)
+		if err != nil {
+			c.String(storageErrorStatus(err), "")
+			return
+		}
+		c.JSON(http.StatusConflict, PostJSONResponse{Result: fmt.Sprintf("%s/%s", h.Config.BaseURL, ID)})
+		return
+	}
+
+	c.String(storageErrorStatus(err), "")
+}
+
 func (h Handler) UserURLsGetHandler(c *gin.Context) {
 	userIDEnc, err := c.Cookie("user-id")
 	if err != nil {
@@ -97,7 +209,11 @@ func (h Handler) UserURLsGetHandler(c *gin.Context) {
 		return
 	}
 
-	userLinks := h.Storage.GetUserURLs(userIDDec)
+	userLinks, err := h.Storage.GetUserURLs(c.Request.Context(), userIDDec)
+	if err != nil {
+		c.JSON(storageErrorStatus(err), "")
+		return
+	}
 	if len(userLinks) == 0 {
 		c.JSON(http.StatusNoContent, "{}")
 		return
@@ -105,25 +221,117 @@ func (h Handler) UserURLsGetHandler(c *gin.Context) {
 
 	res := make([]UserLinkItem, 0)
 	for _, ul := range userLinks {
-		res = append(res, UserLinkItem{
-			fmt.Sprintf("%s/%s", h.Config.BaseURL, ul.ID),
-			ul.OriginalURL,
-		})
+		item := UserLinkItem{
+			SortURL:     fmt.Sprintf("%s/%s", h.Config.BaseURL, ul.ID),
+			OriginalURL: ul.OriginalURL,
+		}
+		if !ul.ExpiresAt.IsZero() {
+			expiresAt := ul.ExpiresAt
+			item.ExpiresAt = &expiresAt
+		}
+		res = append(res, item)
 	}
 
 	c.JSON(http.StatusOK, res)
 }
 
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 365
+)
+
+// LinkStatsHandler reports the clicks on a link of the current user: the
+// total and a daily series over the last days (30 by default, up to 365),
+// today included.
+func (h Handler) LinkStatsHandler(c *gin.Context) {
+	ID := c.Param("ID")
+	userID := c.GetString("user-id")
+
+	days := defaultStatsDays
+	if q := c.Query("days"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n < 1 || n > maxStatsDays {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("days must be 1 to %d", maxStatsDays)})
+			return
+		}
+		days = n
+	}
+
+	link, err := h.Storage.GetLinkByID(c.Request.Context(), ID)
+	if err != nil {
+		c.String(storageErrorStatus(err), "")
+		return
+	}
+	// Links of other users are reported as missing, not as forbidden, so
+	// that their IDs can't be probed.
+	if link.ID == "" || link.UserID != userID {
+		c.String(http.StatusNotFound, "")
+		return
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	since := today.AddDate(0, 0, 1-days)
+	stats, err := h.Storage.GetClickStats(c.Request.Context(), ID, since)
+	if err != nil {
+		c.String(storageErrorStatus(err), "")
+		return
+	}
+
+	clicks := make(map[time.Time]int64, len(stats.Daily))
+	for _, d := range stats.Daily {
+		clicks[d.Day] = d.Clicks
+	}
+	res := LinkStatsResponse{
+		SortURL: fmt.Sprintf("%s/%s", h.Config.BaseURL, ID),
+		Total:   stats.Total,
+		Daily:   make([]DailyClicksItem, 0, days),
+	}
+	for day := since; !day.After(today); day = day.AddDate(0, 0, 1) {
+		res.Daily = append(res.Daily, DailyClicksItem{Date: day.Format("2006-01-02"), Clicks: clicks[day]})
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// ServiceStatsHandler reports the totals of the service. Only the callers
+// from the trusted subnet may see them; the address is taken from the
+// connection, not from the forwarding headers, which are easy to forge.
+func (h Handler) ServiceStatsHandler(c *gin.Context) {
+	ip, _ := c.RemoteIP()
+	if h.TrustedSubnet == nil || ip == nil || !h.TrustedSubnet.Contains(ip) {
+		c.String(http.StatusForbidden, "")
+		return
+	}
+
+	stats, err := h.Storage.GetServiceStats(c.Request.Context())
+	if err != nil {
+		c.String(storageErrorStatus(err), "")
+		return
+	}
+
+	c.JSON(http.StatusOK, ServiceStatsResponse{
+		URLs:    stats.URLs,
+		Users:   stats.Users,
+		Deleted: stats.Deleted,
+		Clicks:  stats.Clicks,
+	})
+}
+
 func (h Handler) DBPingHandler(c *gin.Context) {
-	_, err := h.Storage.GetURLByID("fake_id")
+	err := h.Storage.Ping(c.Request.Context())
 	if err != nil {
-		c.String(http.StatusInternalServerError, "")
+		c.String(storageErrorStatus(err), "")
 		return
 	}
 
 	c.String(http.StatusOK, "")
 }
 
+// ShortenBatchHandler stores the valid items of the batch in one storage
+// call and reports the status of every item. Short IDs are generated by the
+// server; correlation_id only matches the items of the response to those of
+// the request and has to be unique within it. The response is 201 Created
+// when every item was created and 207 Multi-Status otherwise.
 func (h Handler) ShortenBatchHandler(c *gin.Context) {
 	var req ShortenBatchRequest
 	userID := c.GetString("user-id")
@@ -134,45 +342,189 @@ func (h Handler) ShortenBatchHandler(c *gin.Context) {
 		return
 	}
 
-	links := make([]storage.ShortLink, 0)
-
-	for _, link := range req {
-		links = append(links, storage.ShortLink{ID: link.ID, OriginalURL: link.URL, UserID: userID})
+	correlationIDs := make(map[string]struct{}, len(req))
+	for _, item := range req {
+		if _, ok := correlationIDs[item.ID]; ok {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("duplicate correlation_id %q", item.ID)})
+			return
+		}
+		correlationIDs[item.ID] = struct{}{}
 	}
 
-	err = h.Storage.AddURLBatch(links)
-	if err != nil {
-		c.String(http.StatusInternalServerError, "")
-		return
+	now := time.Now()
+	res := make([]BatchLinkItem, len(req))
+	links := make([]storage.ShortLink, 0, len(req))
+	stored := make([]int, 0, len(req))
+
+	for n, item := range req {
+		res[n].ID = item.ID
+		if item.ID == "" {
+			res[n].Status, res[n].Error = BatchInvalid, "empty correlation_id"
+			continue
+		}
+		if !isValidURL(item.URL) {
+			res[n].Status, res[n].Error = BatchInvalid, "invalid original_url"
+			continue
+		}
+		expiresAt, err := linkExpiry(item.ExpiresAt, item.TTL, now)
+		if err != nil {
+			res[n].Status, res[n].Error = BatchInvalid, err.Error()
+			continue
+		}
+		links = append(links, storage.ShortLink{OriginalURL: item.URL, UserID: userID, ExpiresAt: expiresAt})
+		stored = append(stored, n)
 	}
 
-	res := make([]BatchLinkItem, 0)
+	if len(links) > 0 {
+		results, err := storeNewLinks(h, c, links)
+		if err != nil {
+			c.String(storageErrorStatus(err), "")
+			return
+		}
+		for k, n := range stored {
+			res[n].SortURL = fmt.Sprintf("%s/%s", h.Config.BaseURL, results[k].ID)
+			res[n].Status = results[k].Status
+		}
+	}
 
-	for _, link := range links {
-		res = append(res, BatchLinkItem{ID: link.ID, SortURL: fmt.Sprintf("%s/%s", h.Config.BaseURL, link.ID)})
+	status := http.StatusCreated
+	for _, item := range res {
+		if item.Status != BatchCreated {
+			status = http.StatusMultiStatus
+			break
+		}
 	}
 
-	c.JSON(http.StatusCreated, res)
+	c.JSON(status, res)
 }
 
-func storeNewLink(h Handler, c *gin.Context, URL string) (string, error) {
-	urlID := uuid.NewV4().String()
-	userID := c.GetString("user-id")
+// linkExpiry resolves the optional expires_at and ttl (in seconds) of a
+// request into the expiry time of the link; zero means it never expires.
+func linkExpiry(expiresAt *time.Time, ttl int64, now time.Time) (time.Time, error) {
+	switch {
+	case expiresAt != nil && ttl != 0:
+		return time.Time{}, errors.New("expires_at and ttl are mutually exclusive")
+	case ttl < 0:
+		return time.Time{}, errors.New("ttl must be positive")
+	case ttl > 0:
+		return now.Add(time.Duration(ttl) * time.Second), nil
+	case expiresAt != nil:
+		if !expiresAt.After(now) {
+			return time.Time{}, errors.New("expires_at must be in the future")
+		}
+		return *expiresAt, nil
+	}
 
-	err := h.Storage.AddURL(storage.ShortLink{ID: urlID, OriginalURL: URL, UserID: userID})
+	return time.Time{}, nil
+}
+
+// isValidURL reports whether URL is an absolute http(s) URL.
+func isValidURL(URL string) bool {
+	u, err := url.ParseRequestURI(URL)
 	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// generateAttempts is the number of IDs tried for a new link before giving
+// up on collisions.
+func (h Handler) generateAttempts() int {
+	if h.Config.IDGenerateAttempts < 1 {
+		return 1
+	}
+	return h.Config.IDGenerateAttempts
+}
+
+// storeNewLink stores link under a generated ID for the current user and
+// returns the ID. If the link duplicates a stored one under
+// Config.DedupScope it returns the ID of that link along with the
+// RecordDuplicateError; only the global scope makes it a link of another
+// user.
+func storeNewLink(h Handler, c *gin.Context, link storage.ShortLink) (string, error) {
+	link.UserID = c.GetString("user-id")
+
+	var err error
+	for attempt := 0; attempt < h.generateAttempts(); attempt++ {
+		var urlID string
+		urlID, err = h.IDs.Generate(link.OriginalURL, attempt)
+		if err != nil {
+			return "", err
+		}
+		if isReserved(urlID) {
+			err = &storage.RecordIDCollisionError{ID: urlID}
+			continue
+		}
+
+		link.ID = urlID
+		err = h.Storage.AddURL(c.Request.Context(), link)
+		var ice *storage.RecordIDCollisionError
+		if errors.As(err, &ice) {
+			continue
+		}
 		var rde *storage.RecordDuplicateError
 		if errors.As(err, &rde) {
-			ex, getErr := h.Storage.GetURLByOriginalURL(URL)
+			ex, getErr := h.Storage.GetURLByOriginalURL(c.Request.Context(), link.OriginalURL, link.UserID)
 			if getErr != nil {
 				return "", getErr
 			}
 			return ex, err
 		}
-		return "", err
+		if err != nil {
+			return "", err
+		}
+
+		return urlID, nil
+	}
+
+	return "", err
+}
+
+// storeNewLinks generates the IDs of links and stores them as a batch. The
+// batch is atomic, so after a collision it is retried with fresh IDs.
+// Generated IDs which are reserved words count as collisions.
+//
+// The hash generator gives a URL repeated in the batch the same ID every
+// time, so an item whose ID an earlier item already has moves on to the
+// following attempt numbers. Whether the repeat is then stored or reported
+// as existing is up to Config.DedupScope, as for separate requests.
+func storeNewLinks(h Handler, c *gin.Context, links []storage.ShortLink) ([]storage.BatchResult, error) {
+	var err error
+	for attempt := 0; attempt < h.generateAttempts(); attempt++ {
+		err = nil
+		taken := make(map[string]struct{}, len(links))
+		for n := range links {
+			links[n].ID, err = h.IDs.Generate(links[n].OriginalURL, attempt)
+			for next := attempt + 1; err == nil && next <= attempt+n; next++ {
+				if _, ok := taken[links[n].ID]; !ok {
+					break
+				}
+				links[n].ID, err = h.IDs.Generate(links[n].OriginalURL, next)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if isReserved(links[n].ID) {
+				err = &storage.RecordIDCollisionError{ID: links[n].ID}
+				break
+			}
+			taken[links[n].ID] = struct{}{}
+		}
+		if err != nil {
+			continue
+		}
+
+		var results []storage.BatchResult
+		results, err = h.Storage.AddURLBatch(c.Request.Context(), links)
+		var ice *storage.RecordIDCollisionError
+		if errors.As(err, &ice) {
+			continue
+		}
+
+		return results, err
 	}
 
-	return urlID, nil
+	return nil, err
 }
 
 func (h Handler) UserURLsDeleteHandler(c *gin.Context) {
@@ -180,10 +532,108 @@ func (h Handler) UserURLsDeleteHandler(c *gin.Context) {
 	userID := c.GetString("user-id")
 	err := json.NewDecoder(c.Request.Body).Decode(&IDs)
 	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "body must be a list of short IDs"})
+		return
+	}
+	jobID, err := h.Deletions.Enqueue(deleter.Request{UserID: userID, IDs: IDs})
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: err.Error()})
+		return
+	}
+	c.Header("Location", "/api/user/jobs/"+jobID)
+	c.JSON(http.StatusAccepted, DeleteJobResponse{JobID: jobID})
+}
+
+// Statuses of the IDs of a restore request.
+const (
+	RestoreRestored = "restored"
+	// RestoreSkipped is an ID of no deleted link of the user, or of a link
+	// deleted before the grace window.
+	RestoreSkipped = "skipped"
+)
+
+// UserURLsRestoreHandler undoes the deletion of the listed links of the
+// current user which were deleted within Config.DeleteGraceWindow, and
+// reports the status of every ID.
+func (h Handler) UserURLsRestoreHandler(c *gin.Context) {
+	var IDs []string
+	userID := c.GetString("user-id")
+	err := json.NewDecoder(c.Request.Body).Decode(&IDs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "body must be a list of short IDs"})
+		return
+	}
+
+	var deletedSince time.Time
+	if h.Config.DeleteGraceWindow > 0 {
+		deletedSince = time.Now().Add(-h.Config.DeleteGraceWindow)
+	}
+	restored, err := h.Storage.RestoreUserURLs(c.Request.Context(), IDs, userID, deletedSince)
+	if err != nil {
+		c.String(storageErrorStatus(err), "")
 		return
 	}
-	go func() {
-		_ = h.Storage.DeleteUserURLs(IDs, userID)
-	}()
-	c.String(http.StatusAccepted, "")
+
+	done := make(map[string]struct{}, len(restored))
+	for _, ID := range restored {
+		done[ID] = struct{}{}
+	}
+	res := make([]RestoreItem, 0, len(IDs))
+	for _, ID := range IDs {
+		item := RestoreItem{ID: ID, Status: RestoreSkipped}
+		if _, ok := done[ID]; ok {
+			item.SortURL = fmt.Sprintf("%s/%s", h.Config.BaseURL, ID)
+			item.Status = RestoreRestored
+		}
+		res = append(res, item)
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// UserJobHandler reports the progress of a deletion job of the current
+// user. Jobs are kept for Config.DeleteJobTTL after they finish.
+func (h Handler) UserJobHandler(c *gin.Context) {
+	job, ok := h.Deletions.Job(c.Param("ID"))
+	if !ok || job.UserID != c.GetString("user-id") {
+		c.String(http.StatusNotFound, "")
+		return
+	}
+
+	counts := job.Counts()
+	res := JobResponse{
+		ID:        job.ID,
+		Status:    deleter.StatusCompleted,
+		Pending:   counts[deleter.StatusPending],
+		Completed: counts[deleter.StatusCompleted],
+		Failed:    counts[deleter.StatusFailed],
+		Skipped:   counts[deleter.StatusSkipped],
+		Items:     make([]JobItem, 0, len(job.IDs)),
+	}
+	switch {
+	case res.Pending > 0:
+		res.Status = deleter.StatusPending
+	case res.Failed > 0:
+		res.Status = deleter.StatusFailed
+	}
+	for _, ID := range job.IDs {
+		res.Items = append(res.Items, JobItem{ID: ID, Status: job.Statuses[ID]})
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// storageErrorStatus maps a storage error to the HTTP status reported to the
+// client: 504 when the operation ran out of time, 503 when the storage could
+// not take the operation at all.
+func storageErrorStatus(err error) int {
+	var ote *storage.OperationTimeoutError
+	if errors.As(err, &ote) {
+		return http.StatusGatewayTimeout
+	}
+	var sue *storage.StorageUnavailableError
+	if errors.As(err, &sue) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
 }
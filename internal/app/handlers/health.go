@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app/storage"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+)
+
+// HealthzHandler is the liveness probe: it only tells that the process
+// serves HTTP, so an unavailable storage does not get the instance killed.
+func (h Handler) HealthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, HealthResponse{Status: healthOK})
+}
+
+// ReadyzHandler is the readiness probe. The instance is ready when the
+// storage answers a ping, its connection pool has a free connection, its
+// schema is migrated to the latest version known to this build and the
+// deletion queue has room; otherwise the response is 503 and the failed
+// checks carry the reason.
+func (h Handler) ReadyzHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	res := ReadinessResponse{Status: healthOK}
+	fail := func(check *HealthCheck, err error) {
+		check.Status = healthFail
+		check.Error = err.Error()
+		res.Status = healthFail
+	}
+
+	res.Storage.Status = healthOK
+	err := h.Storage.Ping(ctx)
+	if err != nil {
+		fail(&res.Storage, err)
+	}
+
+	if ps, ok := h.Storage.(storage.PoolStatter); ok {
+		st := ps.PoolStats()
+		res.Pool = &PoolCheck{
+			HealthCheck: HealthCheck{Status: healthOK},
+			Total:       st.Total,
+			Idle:        st.Idle,
+			Acquired:    st.Acquired,
+			Max:         st.Max,
+		}
+		if st.Saturated() {
+			fail(&res.Pool.HealthCheck, errors.New("all connections are in use"))
+		}
+	}
+
+	if sv, ok := h.Storage.(storage.SchemaVersioner); ok {
+		current, latest, err := sv.SchemaVersion(ctx)
+		res.Migrations = &MigrationsCheck{
+			HealthCheck: HealthCheck{Status: healthOK},
+			Current:     current,
+			Latest:      latest,
+		}
+		if err != nil {
+			fail(&res.Migrations.HealthCheck, err)
+		} else if current < latest {
+			fail(&res.Migrations.HealthCheck, fmt.Errorf("%d migrations are pending", latest-current))
+		}
+	}
+
+	if h.Deletions != nil {
+		res.Deletions = &QueueCheck{
+			HealthCheck: HealthCheck{Status: healthOK},
+			Depth:       h.Deletions.Depth(),
+			Capacity:    h.Deletions.Capacity(),
+		}
+		if res.Deletions.Depth >= res.Deletions.Capacity {
+			fail(&res.Deletions.HealthCheck, errors.New("deletion queue is full"))
+		}
+	}
+
+	status := http.StatusOK
+	if res.Status != healthOK {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, res)
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// UserURLUpdateHandler points a link of the current user at a new URL. The
+// short ID stays the same and the previous URL is kept in the history of
+// the link.
+func (h Handler) UserURLUpdateHandler(c *gin.Context) {
+	var req UpdateURLRequest
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil || !isValidURL(req.URL) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "url must be an absolute http(s) URL"})
+		return
+	}
+
+	h.retarget(c, req.URL)
+}
+
+// UserURLHistoryHandler lists the URLs a link of the current user has
+// pointed at, oldest first.
+func (h Handler) UserURLHistoryHandler(c *gin.Context) {
+	ID := c.Param("ID")
+	link, err := h.Storage.GetLinkByID(c.Request.Context(), ID)
+	if err != nil {
+		c.String(storageErrorStatus(err), "")
+		return
+	}
+	// As in LinkStatsHandler, links of other users are reported as missing.
+	if link.ID == "" || link.UserID != c.GetString("user-id") {
+		c.String(http.StatusNotFound, "")
+		return
+	}
+
+	history, err := h.Storage.GetURLHistory(c.Request.Context(), ID)
+	if err != nil {
+		c.String(storageErrorStatus(err), "")
+		return
+	}
+
+	res := make([]LinkVersionItem, 0, len(history))
+	for _, v := range history {
+		item := LinkVersionItem{Version: v.Version, OriginalURL: v.OriginalURL}
+		if !v.CreatedAt.IsZero() {
+			createdAt := v.CreatedAt
+			item.CreatedAt = &createdAt
+		}
+		res = append(res, item)
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// UserURLRollbackHandler points a link of the current user back at the URL
+// of an earlier version. The rollback is recorded as a new version, so it
+// can be rolled back in turn.
+func (h Handler) UserURLRollbackHandler(c *gin.Context) {
+	var req RollbackRequest
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil || req.Version < 1 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "version must be a positive number"})
+		return
+	}
+
+	ID := c.Param("ID")
+	link, err := h.Storage.GetLinkByID(c.Request.Context(), ID)
+	if err != nil {
+		c.String(storageErrorStatus(err), "")
+		return
+	}
+	if link.ID == "" || link.UserID != c.GetString("user-id") {
+		c.String(http.StatusNotFound, "")
+		return
+	}
+
+	history, err := h.Storage.GetURLHistory(c.Request.Context(), ID)
+	if err != nil {
+		c.String(storageErrorStatus(err), "")
+		return
+	}
+	for _, v := range history {
+		if v.Version == req.Version {
+			h.retarget(c, v.OriginalURL)
+			return
+		}
+	}
+
+	c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("link %s has no version %d", ID, req.Version)})
+}
+
+// retarget points the link named by the ID parameter at URL and reports
+// the version it got.
+func (h Handler) retarget(c *gin.Context, URL string) {
+	ID := c.Param("ID")
+	version, err := h.Storage.UpdateURL(c.Request.Context(), ID, c.GetString("user-id"), URL)
+	if err != nil {
+		var rsde *storage.RecordSoftDeletedError
+		if errors.As(err, &rsde) {
+			c.String(http.StatusGone, "")
+			return
+		}
+		var rde *storage.RecordDuplicateError
+		if errors.As(err, &rde) {
+			c.JSON(http.StatusConflict, ErrorResponse{Error: fmt.Sprintf("%s is already shortened", URL)})
+			return
+		}
+		c.String(storageErrorStatus(err), "")
+		return
+	}
+	if version == 0 {
+		c.String(http.StatusNotFound, "")
+		return
+	}
+
+	c.JSON(http.StatusOK, UpdateURLResponse{
+		SortURL:     fmt.Sprintf("%s/%s", h.Config.BaseURL, ID),
+		OriginalURL: URL,
+		Version:     version,
+	})
+}
@@ -1,10 +1,27 @@
 package handlers
 
+import "time"
+
+// PostJSONRequest and the items of ShortenBatchRequest may limit the life
+// of the link either with an absolute expires_at or with a ttl in seconds.
 type PostJSONRequest struct {
-	URL string `json:"url"`
+	URL       string     `json:"url"`
+	Alias     string     `json:"alias,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	TTL       int64      `json:"ttl,omitempty"`
 }
 
 type ShortenBatchRequest []struct {
-	ID  string `json:"correlation_id"`
-	URL string `json:"original_url"`
+	ID        string     `json:"correlation_id"`
+	URL       string     `json:"original_url"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	TTL       int64      `json:"ttl,omitempty"`
+}
+
+type UpdateURLRequest struct {
+	URL string `json:"url"`
+}
+
+type RollbackRequest struct {
+	Version int `json:"version"`
 }
@@ -1,15 +1,136 @@
 package handlers
 
+import (
+	"time"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app/storage"
+)
+
 type PostJSONResponse struct {
 	Result string `json:"result"`
 }
 
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
 type UserLinkItem struct {
-	SortURL     string `json:"short_url"`
-	OriginalURL string `json:"original_url"`
+	SortURL     string     `json:"short_url"`
+	OriginalURL string     `json:"original_url"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
 }
 
+// Statuses of the items of a batch response. The storage statuses are
+// reported as is, BatchInvalid marks items which were not stored.
+const (
+	BatchCreated  = storage.BatchCreated
+	BatchExisting = storage.BatchExisting
+	BatchInvalid  = "invalid"
+)
+
 type BatchLinkItem struct {
 	ID      string `json:"correlation_id"`
-	SortURL string `json:"short_url"`
+	SortURL string `json:"short_url,omitempty"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+type LinkStatsResponse struct {
+	SortURL string            `json:"short_url"`
+	Total   int64             `json:"total"`
+	Daily   []DailyClicksItem `json:"daily"`
+}
+
+type DailyClicksItem struct {
+	Date   string `json:"date"`
+	Clicks int64  `json:"clicks"`
+}
+
+type ServiceStatsResponse struct {
+	URLs    int64 `json:"urls"`
+	Users   int64 `json:"users"`
+	Deleted int64 `json:"deleted"`
+	Clicks  int64 `json:"clicks"`
+}
+
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+type HealthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ReadinessResponse reports the checks of ReadyzHandler. Pool and
+// Migrations are omitted for the storages without a connection pool or a
+// schema.
+type ReadinessResponse struct {
+	Status     string           `json:"status"`
+	Storage    HealthCheck      `json:"storage"`
+	Pool       *PoolCheck       `json:"pool,omitempty"`
+	Migrations *MigrationsCheck `json:"migrations,omitempty"`
+	Deletions  *QueueCheck      `json:"deletions,omitempty"`
+}
+
+type PoolCheck struct {
+	HealthCheck
+	Total    int32 `json:"total"`
+	Idle     int32 `json:"idle"`
+	Acquired int32 `json:"acquired"`
+	Max      int32 `json:"max"`
+}
+
+type MigrationsCheck struct {
+	HealthCheck
+	Current int `json:"current"`
+	Latest  int `json:"latest"`
+}
+
+type QueueCheck struct {
+	HealthCheck
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+}
+
+type DeleteJobResponse struct {
+	JobID string `json:"job_id"`
+}
+
+// JobResponse reports a deletion job: its overall status, which is pending
+// until every ID is processed and failed if any ID failed, the number of
+// IDs in each status and the status of each ID.
+type JobResponse struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"`
+	Pending   int       `json:"pending"`
+	Completed int       `json:"completed"`
+	Failed    int       `json:"failed"`
+	Skipped   int       `json:"skipped"`
+	Items     []JobItem `json:"items"`
+}
+
+type JobItem struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+type RestoreItem struct {
+	ID      string `json:"id"`
+	SortURL string `json:"short_url,omitempty"`
+	Status  string `json:"status"`
+}
+
+type UpdateURLResponse struct {
+	SortURL     string `json:"short_url"`
+	OriginalURL string `json:"original_url"`
+	Version     int    `json:"version"`
+}
+
+// LinkVersionItem is a URL a link has pointed at. The time is unknown for
+// the first version of the links created before the history was kept.
+type LinkVersionItem struct {
+	Version     int        `json:"version"`
+	OriginalURL string     `json:"original_url"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
 }
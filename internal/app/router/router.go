@@ -3,25 +3,31 @@ package router
 import (
 	"github.com/JamesDeGreese/ya_golang/internal/app"
 	"github.com/JamesDeGreese/ya_golang/internal/app/handlers"
-	"github.com/JamesDeGreese/ya_golang/internal/app/storage"
 	"github.com/gin-contrib/gzip"
 	"github.com/gin-gonic/gin"
 )
 
-func SetupRouter(c app.Config, s storage.Repository) *gin.Engine {
+func SetupRouter(h handlers.Handler) *gin.Engine {
 	r := gin.Default()
 	r.Use(gzip.Gzip(gzip.BestSpeed, gzip.WithDecompressFn(gzip.DefaultDecompressHandle)))
-	r.Use(app.AuthCookieMiddleware(c))
-	h := handlers.Handler{
-		Config:  c,
-		Storage: s,
-	}
+	r.Use(app.AuthCookieMiddleware(h.Config))
+	// The first path segment of every route is reserved in
+	// handlers.reservedAliases.
 	r.GET("/:ID", h.GetHandler)
 	r.POST("/", h.PostHandler)
 	r.POST("/api/shorten", h.PostHandlerJSON)
 	r.GET("/api/user/urls", h.UserURLsGetHandler)
 	r.DELETE("/api/user/urls", h.UserURLsDeleteHandler)
+	r.POST("/api/user/urls/restore", h.UserURLsRestoreHandler)
+	r.PATCH("/api/user/urls/:ID", h.UserURLUpdateHandler)
+	r.GET("/api/user/urls/:ID/stats", h.LinkStatsHandler)
+	r.GET("/api/user/urls/:ID/history", h.UserURLHistoryHandler)
+	r.POST("/api/user/urls/:ID/rollback", h.UserURLRollbackHandler)
+	r.GET("/api/user/jobs/:ID", h.UserJobHandler)
+	r.GET("/api/internal/stats", h.ServiceStatsHandler)
 	r.GET("/ping", h.DBPingHandler)
+	r.GET("/healthz", h.HealthzHandler)
+	r.GET("/readyz", h.ReadyzHandler)
 	r.POST("/api/shorten/batch", h.ShortenBatchHandler)
 	return r
 }
@@ -0,0 +1,199 @@
+// Package shortid generates the short IDs of new links.
+package shortid
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app"
+	"github.com/JamesDeGreese/ya_golang/internal/app/storage"
+)
+
+const (
+	StrategyRandom   = "random"
+	StrategyHash     = "hash"
+	StrategySequence = "sequence"
+)
+
+// alphabet holds the base62 digits in the order used by math/big.
+const alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// maxHashLength is the length of a SHA-256 digest in base62.
+const maxHashLength = 43
+
+// sequencePrefix starts the IDs of the sequence generator. Aliases, random
+// and hash IDs never contain it, so the stored sequence IDs can be told
+// apart from other base62 IDs.
+const sequencePrefix = "~"
+
+// ErrSequenceExhausted is returned by SequenceGenerator once it has handed
+// out the highest number.
+var ErrSequenceExhausted = errors.New("ID sequence is exhausted")
+
+// IDGenerator produces the short ID of a new link. attempt is 0 for the
+// first ID of a link and counts the retries after an ID turned out to be
+// taken, so that a generator can avoid returning the same ID again.
+type IDGenerator interface {
+	Generate(URL string, attempt int) (string, error)
+}
+
+// New returns the generator selected by c.IDGenerator. The sequence
+// generator continues from the highest sequence number among the IDs of the
+// links held by s.
+func New(ctx context.Context, c app.Config, s storage.Repository) (IDGenerator, error) {
+	switch c.IDGenerator {
+	case StrategyRandom:
+		if c.IDLength < 1 {
+			return nil, fmt.Errorf("invalid ID length %d", c.IDLength)
+		}
+		return RandomGenerator{Length: c.IDLength}, nil
+	case StrategyHash:
+		if c.IDLength < 1 || c.IDLength > maxHashLength {
+			return nil, fmt.Errorf("invalid ID length %d, hash IDs are 1 to %d characters long", c.IDLength, maxHashLength)
+		}
+		return HashGenerator{Length: c.IDLength}, nil
+	case StrategySequence:
+		// Links may have been purged, so the number of stored links can be
+		// below the numbers already handed out; the highest stored number is
+		// continued instead. Only IDs carrying sequencePrefix are numbers of
+		// the sequence; any other ID can't collide with it.
+		var start uint64
+		if w, ok := s.(storage.LinkIDWalker); ok {
+			err := w.WalkLinkIDs(ctx, func(ID string) {
+				if !strings.HasPrefix(ID, sequencePrefix) {
+					return
+				}
+				if n, ok := decode(ID[len(sequencePrefix):]); ok && n > start {
+					start = n
+				}
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return NewSequenceGenerator(start), nil
+	}
+
+	return nil, fmt.Errorf("unknown ID generator %q", c.IDGenerator)
+}
+
+// RandomGenerator returns random base62 IDs of Length characters.
+type RandomGenerator struct {
+	Length int
+}
+
+func (g RandomGenerator) Generate(URL string, attempt int) (string, error) {
+	var sb strings.Builder
+	sb.Grow(g.Length)
+
+	buf := make([]byte, g.Length)
+	for sb.Len() < g.Length {
+		_, err := rand.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			// 248 is the largest multiple of 62 that fits a byte; rejecting
+			// the bytes above it keeps the digits uniformly distributed.
+			if b >= 248 {
+				continue
+			}
+			sb.WriteByte(alphabet[b%62])
+			if sb.Len() == g.Length {
+				break
+			}
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// HashGenerator derives IDs of Length characters from the SHA-256 digest of
+// the URL, so the same URL always gets the same ID. Retries hash the URL
+// together with the attempt number.
+type HashGenerator struct {
+	Length int
+}
+
+func (g HashGenerator) Generate(URL string, attempt int) (string, error) {
+	input := URL
+	if attempt > 0 {
+		input = URL + "\x00" + strconv.Itoa(attempt)
+	}
+	sum := sha256.Sum256([]byte(input))
+
+	code := new(big.Int).SetBytes(sum[:]).Text(62)
+	if len(code) < maxHashLength {
+		code = strings.Repeat("0", maxHashLength-len(code)) + code
+	}
+
+	return code[:g.Length], nil
+}
+
+// SequenceGenerator numbers links consecutively and encodes the numbers in
+// base62 after sequencePrefix. Several instances sharing a storage hand out
+// the same numbers and rely on the retry after a collision to move past each
+// other.
+type SequenceGenerator struct {
+	next uint64
+}
+
+// NewSequenceGenerator returns a generator whose first ID encodes start+1.
+func NewSequenceGenerator(start uint64) *SequenceGenerator {
+	return &SequenceGenerator{next: start}
+}
+
+func (g *SequenceGenerator) Generate(URL string, attempt int) (string, error) {
+	for {
+		n := atomic.LoadUint64(&g.next)
+		if n == math.MaxUint64 {
+			return "", ErrSequenceExhausted
+		}
+		if atomic.CompareAndSwapUint64(&g.next, n, n+1) {
+			return sequencePrefix + encode(n+1), nil
+		}
+	}
+}
+
+func encode(n uint64) string {
+	if n == 0 {
+		return alphabet[:1]
+	}
+
+	var buf [11]byte
+	i := len(buf)
+	for n > 0 {
+		i--
+		buf[i] = alphabet[n%62]
+		n /= 62
+	}
+
+	return string(buf[i:])
+}
+
+// decode is the inverse of encode. It reports false for strings which are
+// not base62 numbers fitting a uint64.
+func decode(s string) (uint64, bool) {
+	if s == "" {
+		return 0, false
+	}
+
+	var n uint64
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(alphabet, s[i])
+		if d < 0 || n > (math.MaxUint64-uint64(d))/62 {
+			return 0, false
+		}
+		n = n*62 + uint64(d)
+	}
+
+	return n, true
+}
@@ -0,0 +1,120 @@
+package shortid
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app"
+	"github.com/JamesDeGreese/ya_golang/internal/app/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func isBase62(s string) bool {
+	for _, r := range s {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRandomGenerator(t *testing.T) {
+	g := RandomGenerator{Length: 8}
+	seen := make(map[string]struct{})
+	for i := 0; i < 1000; i++ {
+		ID, err := g.Generate("https://example.org", 0)
+		require.NoError(t, err)
+		assert.Len(t, ID, 8)
+		assert.True(t, isBase62(ID), ID)
+		seen[ID] = struct{}{}
+	}
+	assert.Len(t, seen, 1000)
+}
+
+func TestHashGenerator(t *testing.T) {
+	g := HashGenerator{Length: 7}
+
+	first, err := g.Generate("https://example.org/a", 0)
+	require.NoError(t, err)
+	assert.Len(t, first, 7)
+	assert.True(t, isBase62(first), first)
+
+	again, _ := g.Generate("https://example.org/a", 0)
+	assert.Equal(t, first, again)
+
+	retry, _ := g.Generate("https://example.org/a", 1)
+	assert.NotEqual(t, first, retry)
+
+	other, _ := g.Generate("https://example.org/b", 0)
+	assert.NotEqual(t, first, other)
+}
+
+func TestSequenceGenerator(t *testing.T) {
+	g := NewSequenceGenerator(59)
+	var IDs []string
+	for i := 0; i < 3; i++ {
+		ID, err := g.Generate("https://example.org", 0)
+		require.NoError(t, err)
+		IDs = append(IDs, ID)
+	}
+	assert.Equal(t, []string{"~Y", "~Z", "~10"}, IDs)
+}
+
+func TestSequenceGeneratorDoesNotWrap(t *testing.T) {
+	g := NewSequenceGenerator(math.MaxUint64 - 1)
+	ID, err := g.Generate("https://example.org", 0)
+	require.NoError(t, err)
+	assert.Equal(t, "~"+encode(math.MaxUint64), ID)
+
+	_, err = g.Generate("https://example.org", 0)
+	assert.ErrorIs(t, err, ErrSequenceExhausted)
+}
+
+func TestNewContinuesSequence(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemoryStorage()
+	// Two sequence links against the highest number 10: counting the links
+	// would restart the sequence at an ID which is still taken. Aliases and
+	// random IDs are base62 as well, but not numbers of the sequence.
+	for _, l := range []storage.ShortLink{
+		{ID: "~3", OriginalURL: "https://example.org/3"},
+		{ID: "~a", OriginalURL: "https://example.org/a"},
+		{ID: "Zzzzzzzzzz", OriginalURL: "https://example.org/alias"},
+		{ID: "ZZZZZZZZZZZZ", OriginalURL: "https://example.org/overflow"},
+		{ID: "2c9b0e1e-4f4b-4ad8-9a3e-0d4c6a3f6b1e", OriginalURL: "https://example.org/uuid"},
+	} {
+		require.NoError(t, s.AddURL(ctx, l))
+	}
+
+	g, err := New(ctx, app.Config{IDGenerator: StrategySequence}, s)
+	require.NoError(t, err)
+	ID, err := g.Generate("https://example.org/z", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "~b", ID)
+}
+
+func TestDecode(t *testing.T) {
+	for _, n := range []uint64{0, 1, 61, 62, 3843, math.MaxUint64} {
+		got, ok := decode(encode(n))
+		assert.True(t, ok, n)
+		assert.Equal(t, n, got)
+	}
+
+	for _, s := range []string{"", "a-b", "ZZZZZZZZZZZZ"} {
+		_, ok := decode(s)
+		assert.False(t, ok, s)
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	for _, c := range []app.Config{
+		{IDGenerator: "uuid", IDLength: 8},
+		{IDGenerator: StrategyRandom, IDLength: 0},
+		{IDGenerator: StrategyHash, IDLength: maxHashLength + 1},
+	} {
+		_, err := New(context.Background(), c, storage.NewMemoryStorage())
+		assert.Error(t, err, "%+v", c)
+	}
+}
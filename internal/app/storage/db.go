@@ -0,0 +1,715 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// dbPrimaryKey is the constraint keeping short IDs unique.
+const dbPrimaryKey = "shorten_urls_pkey"
+
+type DBStorage struct {
+	Pool           *pgxpool.Pool
+	AcquireTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	// DedupScope is one of the Dedup scopes.
+	DedupScope string
+}
+
+func NewDBStorage(ctx context.Context, c app.Config) (*DBStorage, error) {
+	pc, err := pgxpool.ParseConfig(c.DatabaseDSN)
+	if err != nil {
+		return nil, err
+	}
+	pc.MinConns = c.DatabaseMinConns
+	pc.MaxConns = c.DatabaseMaxConns
+	pc.HealthCheckPeriod = c.DatabaseHealthCheckPeriod
+
+	pool, err := pgxpool.ConnectConfig(ctx, pc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DBStorage{
+		Pool:           pool,
+		AcquireTimeout: c.DatabaseAcquireTimeout,
+		ReadTimeout:    c.StorageReadTimeout,
+		WriteTimeout:   c.StorageWriteTimeout,
+		DedupScope:     c.DedupScope,
+	}, nil
+}
+
+// acquire takes a connection from the pool, giving up after AcquireTimeout
+// so that a saturated pool fails fast instead of queueing requests forever.
+func (s DBStorage) acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	actx, cancel := withTimeout(ctx, s.AcquireTimeout)
+	defer cancel()
+
+	conn, err := s.Pool.Acquire(actx)
+	if err != nil {
+		if ctx.Err() == nil && actx.Err() != nil {
+			return nil, &StorageUnavailableError{Err: err}
+		}
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (s DBStorage) GetURLByID(ctx context.Context, ID string) (string, error) {
+	var res struct {
+		originalURL string
+		isDeleted   bool
+		expiresAt   *time.Time
+	}
+
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return "", wrapTimeout("GetURLByID", err)
+	}
+	defer conn.Release()
+
+	err = conn.QueryRow(ctx, "SELECT original_url, is_deleted, expires_at FROM shorten_urls WHERE id = $1", ID).Scan(&res.originalURL, &res.isDeleted, &res.expiresAt)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", wrapTimeout("GetURLByID", err)
+	}
+
+	if res.isDeleted {
+		return "", &RecordSoftDeletedError{ID}
+	}
+	if res.expiresAt != nil && isExpired(*res.expiresAt, time.Now()) {
+		return "", &RecordExpiredError{ID}
+	}
+
+	return res.originalURL, nil
+}
+
+func (s DBStorage) GetLinkByID(ctx context.Context, ID string) (ShortLink, error) {
+	res := ShortLink{ID: ID}
+	var expiresAt *time.Time
+
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return ShortLink{}, wrapTimeout("GetLinkByID", err)
+	}
+	defer conn.Release()
+
+	err = conn.QueryRow(ctx, "SELECT original_url, COALESCE(user_id, ''), expires_at FROM shorten_urls WHERE id = $1", ID).Scan(&res.OriginalURL, &res.UserID, &expiresAt)
+	if err == pgx.ErrNoRows {
+		return ShortLink{}, nil
+	}
+	if err != nil {
+		return ShortLink{}, wrapTimeout("GetLinkByID", err)
+	}
+	res.ExpiresAt = fromNullTime(expiresAt)
+
+	return res, nil
+}
+
+func (s DBStorage) GetURLByOriginalURL(ctx context.Context, OriginalURL string, userID string) (string, error) {
+	var res string
+
+	key := nullDedupKey(s.DedupScope, userID, OriginalURL)
+	if key == nil {
+		return "", nil
+	}
+
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return "", wrapTimeout("GetURLByOriginalURL", err)
+	}
+	defer conn.Release()
+
+	err = conn.QueryRow(ctx, "SELECT id FROM shorten_urls WHERE dedup_key = $1", key).Scan(&res)
+	if err == pgx.ErrNoRows {
+		return res, nil
+	}
+	if err != nil {
+		return "", wrapTimeout("GetURLByOriginalURL", err)
+	}
+
+	return res, nil
+}
+
+func (s DBStorage) GetUserURLs(ctx context.Context, userID string) ([]ShortLink, error) {
+	res := make([]ShortLink, 0)
+
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return nil, wrapTimeout("GetUserURLs", err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT id, original_url, expires_at FROM shorten_urls WHERE user_id = $1", userID)
+	if err != nil {
+		return nil, wrapTimeout("GetUserURLs", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := ShortLink{UserID: userID}
+		var expiresAt *time.Time
+		err := rows.Scan(&r.ID, &r.OriginalURL, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		r.ExpiresAt = fromNullTime(expiresAt)
+		res = append(res, r)
+	}
+
+	return res, wrapTimeout("GetUserURLs", rows.Err())
+}
+
+// AddURL stores link. An expired link it duplicates is purged to make room
+// for it.
+func (s DBStorage) AddURL(ctx context.Context, link ShortLink) error {
+	ctx, cancel := withTimeout(ctx, s.WriteTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return wrapTimeout("AddURL", err)
+	}
+	defer conn.Release()
+
+	err = s.insertURL(ctx, conn, link)
+	var rde *RecordDuplicateError
+	if errors.As(err, &rde) {
+		tag, purgeErr := conn.Exec(ctx, "DELETE FROM shorten_urls WHERE dedup_key = $1 AND expires_at <= $2", nullDedupKey(s.DedupScope, link.UserID, link.OriginalURL), time.Now())
+		if purgeErr != nil {
+			return wrapTimeout("AddURL", purgeErr)
+		}
+		if tag.RowsAffected() > 0 {
+			err = s.insertURL(ctx, conn, link)
+		}
+	}
+
+	return err
+}
+
+func (s DBStorage) insertURL(ctx context.Context, conn *pgxpool.Conn, link ShortLink) error {
+	_, err := conn.Exec(ctx, "INSERT INTO shorten_urls (id, original_url, user_id, expires_at, dedup_key) VALUES ($1, $2, $3, $4, $5)", link.ID, link.OriginalURL, link.UserID, toNullTime(link.ExpiresAt), nullDedupKey(s.DedupScope, link.UserID, link.OriginalURL))
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			if pgErr.Code == pgerrcode.UniqueViolation {
+				if pgErr.ConstraintName == dbPrimaryKey {
+					return &RecordIDCollisionError{link.ID}
+				}
+				return &RecordDuplicateError{param: "original_url", value: link.OriginalURL}
+			}
+		}
+		return wrapTimeout("AddURL", err)
+	}
+
+	return nil
+}
+
+// dbBatchInsert inserts a link unless it duplicates a stored one, and
+// returns the short ID of the link or of the duplicate and whether the link
+// was inserted.
+const dbBatchInsert = `WITH ins AS (
+	INSERT INTO shorten_urls (id, original_url, user_id, expires_at, dedup_key) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (dedup_key) DO NOTHING
+	RETURNING id
+)
+SELECT id, true FROM ins
+UNION ALL
+SELECT id, false FROM shorten_urls WHERE dedup_key = $5 AND NOT EXISTS (SELECT 1 FROM ins)`
+
+func (s DBStorage) AddURLBatch(ctx context.Context, links []ShortLink) ([]BatchResult, error) {
+	ctx, cancel := withTimeout(ctx, s.WriteTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return nil, wrapTimeout("AddURLBatch", err)
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, wrapTimeout("AddURLBatch", err)
+	}
+	defer tx.Rollback(ctx)
+
+	keys := make([]*string, len(links))
+	purgeKeys := make([]string, 0, len(links))
+	for n, link := range links {
+		keys[n] = nullDedupKey(s.DedupScope, link.UserID, link.OriginalURL)
+		if keys[n] != nil {
+			purgeKeys = append(purgeKeys, *keys[n])
+		}
+	}
+	preparedKeys := &pgtype.TextArray{}
+	err = preparedKeys.Set(purgeKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &pgx.Batch{}
+	// Expired links give up their dedup keys to the new ones.
+	batch.Queue("DELETE FROM shorten_urls WHERE dedup_key = ANY($1) AND expires_at <= $2", preparedKeys, time.Now())
+	for n, link := range links {
+		batch.Queue(dbBatchInsert, link.ID, link.OriginalURL, link.UserID, toNullTime(link.ExpiresAt), keys[n])
+	}
+	br := tx.SendBatch(ctx, batch)
+
+	_, err = br.Exec()
+	if err != nil {
+		br.Close()
+		return nil, wrapTimeout("AddURLBatch", err)
+	}
+
+	res := make([]BatchResult, len(links))
+	for n, link := range links {
+		var inserted bool
+		err = br.QueryRow().Scan(&res[n].ID, &inserted)
+		if err != nil {
+			br.Close()
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+				return nil, &RecordIDCollisionError{link.ID}
+			}
+			return nil, wrapTimeout("AddURLBatch", err)
+		}
+		res[n].Status = BatchExisting
+		if inserted {
+			res[n].Status = BatchCreated
+		}
+	}
+	err = br.Close()
+	if err != nil {
+		return nil, wrapTimeout("AddURLBatch", err)
+	}
+
+	return res, wrapTimeout("AddURLBatch", tx.Commit(ctx))
+}
+
+func (s DBStorage) PurgeExpired(ctx context.Context, before time.Time) (int64, error) {
+	ctx, cancel := withTimeout(ctx, s.WriteTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return 0, wrapTimeout("PurgeExpired", err)
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, "DELETE FROM shorten_urls WHERE expires_at <= $1", before)
+	if err != nil {
+		return 0, wrapTimeout("PurgeExpired", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// AddClicks inserts clicks in one statement. The join drops the clicks on
+// links which were removed in the meantime.
+func (s DBStorage) AddClicks(ctx context.Context, clicks []Click) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+
+	IDs := make([]string, len(clicks))
+	ats := make([]time.Time, len(clicks))
+	referrers := make([]string, len(clicks))
+	userAgents := make([]string, len(clicks))
+	IPHashes := make([]string, len(clicks))
+	for n, click := range clicks {
+		IDs[n], ats[n], referrers[n], userAgents[n], IPHashes[n] = click.LinkID, click.At, click.Referrer, click.UserAgent, click.IPHash
+	}
+
+	ctx, cancel := withTimeout(ctx, s.WriteTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return wrapTimeout("AddClicks", err)
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO clicks (link_id, clicked_at, referrer, user_agent, ip_hash)
+SELECT c.link_id, c.clicked_at, c.referrer, c.user_agent, c.ip_hash
+FROM unnest($1::text[], $2::timestamptz[], $3::text[], $4::text[], $5::text[]) AS c (link_id, clicked_at, referrer, user_agent, ip_hash)
+JOIN shorten_urls ON shorten_urls.id = c.link_id`, IDs, ats, referrers, userAgents, IPHashes)
+
+	return wrapTimeout("AddClicks", err)
+}
+
+func (s DBStorage) GetClickStats(ctx context.Context, ID string, since time.Time) (ClickStats, error) {
+	var res ClickStats
+
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return res, wrapTimeout("GetClickStats", err)
+	}
+	defer conn.Release()
+
+	err = conn.QueryRow(ctx, "SELECT count(*) FROM clicks WHERE link_id = $1", ID).Scan(&res.Total)
+	if err != nil {
+		return res, wrapTimeout("GetClickStats", err)
+	}
+
+	rows, err := conn.Query(ctx, `SELECT date_trunc('day', clicked_at AT TIME ZONE 'UTC') AS day, count(*)
+FROM clicks WHERE link_id = $1 AND clicked_at >= $2
+GROUP BY day ORDER BY day`, ID, since.UTC().Truncate(24*time.Hour))
+	if err != nil {
+		return res, wrapTimeout("GetClickStats", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d DailyClicks
+		err := rows.Scan(&d.Day, &d.Clicks)
+		if err != nil {
+			return res, err
+		}
+		d.Day = d.Day.UTC()
+		res.Daily = append(res.Daily, d)
+	}
+
+	return res, wrapTimeout("GetClickStats", rows.Err())
+}
+
+func (s DBStorage) GetServiceStats(ctx context.Context) (ServiceStats, error) {
+	var res ServiceStats
+
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return res, wrapTimeout("GetServiceStats", err)
+	}
+	defer conn.Release()
+
+	err = conn.QueryRow(ctx, `SELECT
+		count(*) FILTER (WHERE is_deleted IS NOT TRUE),
+		count(DISTINCT NULLIF(user_id, '')),
+		count(*) FILTER (WHERE is_deleted),
+		(SELECT count(*) FROM clicks)
+	FROM shorten_urls`).Scan(&res.URLs, &res.Users, &res.Deleted, &res.Clicks)
+	return res, wrapTimeout("GetServiceStats", err)
+}
+
+func (s DBStorage) WalkLinkIDs(ctx context.Context, fn func(ID string)) error {
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return wrapTimeout("WalkLinkIDs", err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT id FROM shorten_urls")
+	if err != nil {
+		return wrapTimeout("WalkLinkIDs", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ID string
+		err := rows.Scan(&ID)
+		if err != nil {
+			return err
+		}
+		fn(ID)
+	}
+
+	return wrapTimeout("WalkLinkIDs", rows.Err())
+}
+
+func (s DBStorage) Ping(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return wrapTimeout("Ping", err)
+	}
+	defer conn.Release()
+
+	return wrapTimeout("Ping", conn.Ping(ctx))
+}
+
+func (s DBStorage) PoolStats() PoolStats {
+	st := s.Pool.Stat()
+	return PoolStats{
+		Total:    st.TotalConns(),
+		Idle:     st.IdleConns(),
+		Acquired: st.AcquiredConns(),
+		Max:      st.MaxConns(),
+	}
+}
+
+func (s DBStorage) SchemaVersion(ctx context.Context) (int, int, error) {
+	latest, err := latestMigration("migrations/postgres")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return 0, latest, wrapTimeout("SchemaVersion", err)
+	}
+	defer conn.Release()
+
+	var current int
+	err = conn.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&current)
+	return current, latest, wrapTimeout("SchemaVersion", err)
+}
+
+func (s DBStorage) CleanUp(ctx context.Context, c app.Config) {
+	s.Pool.Close()
+}
+
+func (s DBStorage) DeleteUserURLs(ctx context.Context, IDs []string, userID string) ([]string, error) {
+	preparedIDs := &pgtype.TextArray{}
+	err := preparedIDs.Set(IDs)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := withTimeout(ctx, s.WriteTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return nil, wrapTimeout("DeleteUserURLs", err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "UPDATE shorten_urls SET is_deleted = true, deleted_at = COALESCE(deleted_at, now()) WHERE user_id = $1 AND id = ANY($2) RETURNING id", userID, preparedIDs)
+	if err != nil {
+		return nil, wrapTimeout("DeleteUserURLs", err)
+	}
+	defer rows.Close()
+
+	var deleted []string
+	for rows.Next() {
+		var ID string
+		err = rows.Scan(&ID)
+		if err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, ID)
+	}
+
+	return deleted, wrapTimeout("DeleteUserURLs", rows.Err())
+}
+
+func (s DBStorage) RestoreUserURLs(ctx context.Context, IDs []string, userID string, deletedSince time.Time) ([]string, error) {
+	preparedIDs := &pgtype.TextArray{}
+	err := preparedIDs.Set(IDs)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := withTimeout(ctx, s.WriteTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return nil, wrapTimeout("RestoreUserURLs", err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `UPDATE shorten_urls SET is_deleted = false, deleted_at = NULL
+WHERE user_id = $1 AND id = ANY($2) AND is_deleted AND deleted_at >= $3 RETURNING id`, userID, preparedIDs, deletedSince)
+	if err != nil {
+		return nil, wrapTimeout("RestoreUserURLs", err)
+	}
+	defer rows.Close()
+
+	var restored []string
+	for rows.Next() {
+		var ID string
+		err = rows.Scan(&ID)
+		if err != nil {
+			return nil, err
+		}
+		restored = append(restored, ID)
+	}
+
+	return restored, wrapTimeout("RestoreUserURLs", rows.Err())
+}
+
+func (s DBStorage) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	ctx, cancel := withTimeout(ctx, s.WriteTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return 0, wrapTimeout("PurgeDeleted", err)
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, "DELETE FROM shorten_urls WHERE is_deleted AND deleted_at < $1", before)
+	if err != nil {
+		return 0, wrapTimeout("PurgeDeleted", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// applyDedupScope rekeys the stored links when DedupScope has changed since
+// they were stored, see dedupRekeySQL.
+func (s DBStorage) applyDedupScope(ctx context.Context) error {
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, query := range dedupRekeySQL(s.DedupScope, "IS DISTINCT FROM") {
+		_, err = tx.Exec(ctx, query)
+		if err != nil {
+			return fmt.Errorf("apply dedup scope %q: %w", s.DedupScope, err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// UpdateURL locks the row of the link for the transaction, so concurrent
+// updates of a link get consecutive versions. The first update also records
+// the URL the link was created with as version 1.
+func (s DBStorage) UpdateURL(ctx context.Context, ID string, userID string, originalURL string) (int, error) {
+	ctx, cancel := withTimeout(ctx, s.WriteTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return 0, wrapTimeout("UpdateURL", err)
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, wrapTimeout("UpdateURL", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var current string
+	var isDeleted bool
+	err = tx.QueryRow(ctx, "SELECT original_url, COALESCE(is_deleted, false) FROM shorten_urls WHERE id = $1 AND user_id = $2 FOR UPDATE", ID, userID).Scan(&current, &isDeleted)
+	if err == pgx.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, wrapTimeout("UpdateURL", err)
+	}
+	if isDeleted {
+		return 0, &RecordSoftDeletedError{ID}
+	}
+
+	var version int
+	err = tx.QueryRow(ctx, "SELECT COALESCE(MAX(version), 1) FROM link_history WHERE link_id = $1", ID).Scan(&version)
+	if err != nil {
+		return 0, wrapTimeout("UpdateURL", err)
+	}
+	if current == originalURL {
+		return version, nil
+	}
+	if version == 1 {
+		_, err = tx.Exec(ctx, "INSERT INTO link_history (link_id, version, original_url) VALUES ($1, 1, $2) ON CONFLICT DO NOTHING", ID, current)
+		if err != nil {
+			return 0, wrapTimeout("UpdateURL", err)
+		}
+	}
+	version++
+
+	_, err = tx.Exec(ctx, "UPDATE shorten_urls SET original_url = $1, dedup_key = $2 WHERE id = $3", originalURL, nullDedupKey(s.DedupScope, userID, originalURL), ID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return 0, &RecordDuplicateError{param: "original_url", value: originalURL}
+		}
+		return 0, wrapTimeout("UpdateURL", err)
+	}
+	_, err = tx.Exec(ctx, "INSERT INTO link_history (link_id, version, original_url, created_at) VALUES ($1, $2, $3, now())", ID, version, originalURL)
+	if err != nil {
+		return 0, wrapTimeout("UpdateURL", err)
+	}
+
+	return version, wrapTimeout("UpdateURL", tx.Commit(ctx))
+}
+
+// GetURLHistory reads the history table. A link which was never updated has
+// no history rows, and its current URL is reported as version 1.
+func (s DBStorage) GetURLHistory(ctx context.Context, ID string) ([]LinkVersion, error) {
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return nil, wrapTimeout("GetURLHistory", err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT version, original_url, created_at FROM link_history WHERE link_id = $1 ORDER BY version", ID)
+	if err != nil {
+		return nil, wrapTimeout("GetURLHistory", err)
+	}
+	defer rows.Close()
+
+	var res []LinkVersion
+	for rows.Next() {
+		var v LinkVersion
+		var createdAt *time.Time
+		err = rows.Scan(&v.Version, &v.OriginalURL, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		v.CreatedAt = fromNullTime(createdAt)
+		res = append(res, v)
+	}
+	err = rows.Err()
+	if err != nil || len(res) > 0 {
+		return res, wrapTimeout("GetURLHistory", err)
+	}
+
+	var originalURL string
+	err = conn.QueryRow(ctx, "SELECT original_url FROM shorten_urls WHERE id = $1", ID).Scan(&originalURL)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, wrapTimeout("GetURLHistory", err)
+	}
+
+	return []LinkVersion{{Version: 1, OriginalURL: originalURL}}, nil
+}
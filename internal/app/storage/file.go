@@ -0,0 +1,621 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app"
+)
+
+const (
+	SyncAlways   = "always"
+	SyncInterval = "interval"
+	SyncNever    = "never"
+)
+
+// fileFormat and fileVersion identify the files of the file storage. Version
+// 1 is the headerless CSV written by older releases; it is still read and is
+// rewritten in the current format on startup. Version 3 numbers the records
+// of the log, see fileRecord.Seq.
+const (
+	fileFormat  = "shortener-links"
+	fileVersion = 3
+)
+
+const (
+	fileOpAdd     = "add"
+	fileOpDelete  = "delete"
+	fileOpRestore = "restore"
+	fileOpUpdate  = "update"
+	fileOpPurge   = "purge"
+	fileOpClicks  = "clicks"
+)
+
+// fileHeader opens every file. The header of a snapshot also tells the Seq
+// of the last log record the snapshot reflects.
+type fileHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Seq     uint64 `json:"seq,omitempty"`
+}
+
+// fileRecord is a line of the snapshot or the log. An add record carries the
+// whole state of a link, a delete record marks the listed IDs of a user as
+// deleted and a restore record undoes that, an update record points a link
+// to a new URL at CreatedAt, a purge record removes the listed IDs
+// altogether and a clicks record adds to the daily click counts of a link.
+//
+// Records of the log are numbered by Seq in the order they are appended, so
+// that replay can skip those a snapshot already reflects: replaying clicks
+// or update records twice would count the clicks or add the versions twice.
+// The add records of a snapshot have no Seq.
+type fileRecord struct {
+	Op          string            `json:"op"`
+	Seq         uint64            `json:"seq,omitempty"`
+	ID          string            `json:"id,omitempty"`
+	IDs         []string          `json:"ids,omitempty"`
+	OriginalURL string            `json:"original_url,omitempty"`
+	UserID      string            `json:"user_id,omitempty"`
+	Deleted     bool              `json:"deleted,omitempty"`
+	CreatedAt   *time.Time        `json:"created_at,omitempty"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
+	DeletedAt   *time.Time        `json:"deleted_at,omitempty"`
+	Clicks      dayCounts         `json:"clicks,omitempty"`
+	History     []fileLinkVersion `json:"history,omitempty"`
+}
+
+type fileLinkVersion struct {
+	Version     int        `json:"version"`
+	OriginalURL string     `json:"original_url"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+}
+
+func linkRecord(ID string, ml *memoryLink) fileRecord {
+	rec := fileRecord{
+		Op:          fileOpAdd,
+		ID:          ID,
+		OriginalURL: ml.OriginalURL,
+		UserID:      ml.UserID,
+		Deleted:     ml.Deleted,
+	}
+	if !ml.CreatedAt.IsZero() {
+		createdAt := ml.CreatedAt
+		rec.CreatedAt = &createdAt
+	}
+	if !ml.ExpiresAt.IsZero() {
+		expiresAt := ml.ExpiresAt
+		rec.ExpiresAt = &expiresAt
+	}
+	if !ml.DeletedAt.IsZero() {
+		deletedAt := ml.DeletedAt
+		rec.DeletedAt = &deletedAt
+	}
+	if len(ml.Clicks) > 0 {
+		rec.Clicks = make(dayCounts, len(ml.Clicks))
+		rec.Clicks.add(ml.Clicks)
+	}
+	for _, v := range ml.History {
+		fv := fileLinkVersion{Version: v.Version, OriginalURL: v.OriginalURL}
+		if !v.CreatedAt.IsZero() {
+			createdAt := v.CreatedAt
+			fv.CreatedAt = &createdAt
+		}
+		rec.History = append(rec.History, fv)
+	}
+
+	return rec
+}
+
+func writeFileHeader(w io.Writer, seq uint64) error {
+	return json.NewEncoder(w).Encode(fileHeader{Format: fileFormat, Version: fileVersion, Seq: seq})
+}
+
+// fileLog is the append-only log of the file storage. Every change made to a
+// file-backed MemoryStorage is appended to it as a JSON line before the
+// change is acknowledged. The change is appended and made in memory under
+// the locks of the shards it touches, so holding all of them leaves the log
+// and memory in step.
+type fileLog struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	policy string
+	dirty  bool
+	// seq is the Seq of the last appended record.
+	seq uint64
+}
+
+// openFileLog opens the log at path, numbering the appended records from
+// seq on.
+func openFileLog(path string, policy string, seq uint64) (*fileLog, error) {
+	file, err := createLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileLog{
+		path:   path,
+		file:   file,
+		policy: policy,
+		seq:    seq,
+	}, nil
+}
+
+// createLogFile opens the log at path for appending and writes the header
+// if the log is new.
+func createLogFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0664)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err == nil && info.Size() == 0 {
+		err = writeFileHeader(file, 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// append numbers recs and writes them to the log with a single write, so
+// the records of a batch are never interleaved with those of concurrent
+// writers.
+func (l *fileLog) append(recs ...fileRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	seq := l.seq
+	for _, rec := range recs {
+		seq++
+		rec.Seq = seq
+		err := enc.Encode(rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := l.file.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	// A failed write may leave a torn record behind, so its numbers are not
+	// reused.
+	l.seq = seq
+
+	if l.policy == SyncAlways {
+		return l.file.Sync()
+	}
+	l.dirty = true
+
+	return nil
+}
+
+// sync flushes appended records to stable storage if there are any.
+func (l *fileLog) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.dirty {
+		return nil
+	}
+	l.dirty = false
+
+	return l.file.Sync()
+}
+
+// rotate moves the current log aside to oldPath and starts an empty one.
+func (l *fileLog) rotate(oldPath string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.file.Sync()
+	if err != nil {
+		return err
+	}
+	err = l.file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(l.path, oldPath)
+	if err != nil {
+		return err
+	}
+
+	file, err := createLogFile(l.path)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.dirty = false
+
+	return nil
+}
+
+// lastSeq returns the Seq of the last appended record.
+func (l *fileLog) lastSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.seq
+}
+
+func (l *fileLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	return l.file.Close()
+}
+
+func snapshotPath(path string) string {
+	return path + ".snapshot"
+}
+
+func rotatedLogPath(path string) string {
+	return path + ".old"
+}
+
+// compact folds the log into a fresh snapshot of the storage. Writers are
+// held off only while the log is rotated and the links are copied, so the
+// snapshot reflects exactly the records numbered up to the Seq in its
+// header. Those records may still be replayed from a rotated log left behind
+// by a crash, and are then skipped.
+func (s *MemoryStorage) compact() error {
+	oldPath := rotatedLogPath(s.FilePath)
+
+	unlock := s.lockAll()
+	// A rotated log left behind by an unfinished compaction is already
+	// reflected in memory, so it only has to be covered by the next snapshot.
+	if _, err := os.Stat(oldPath); errors.Is(err, os.ErrNotExist) {
+		err = s.log.rotate(oldPath)
+		if err != nil {
+			unlock()
+			return err
+		}
+	}
+	seq := s.log.lastSeq()
+	var recs []fileRecord
+	for i := range s.shards {
+		for ID, ml := range s.shards[i].links {
+			recs = append(recs, linkRecord(ID, ml))
+		}
+	}
+	unlock()
+
+	err := writeSnapshot(snapshotPath(s.FilePath), seq, recs)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(oldPath)
+}
+
+func writeSnapshot(path string, seq uint64, recs []fileRecord) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	err = writeFileHeader(w, seq)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	for _, rec := range recs {
+		err = enc.Encode(rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// replay applies the records of a snapshot or log file to the storage. A
+// last line without a trailing newline was cut short by a crash in the
+// middle of an append and is dropped. Any other malformed record means the
+// file is corrupted and fails the replay.
+func (s *MemoryStorage) replay(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	first, err := r.Peek(1)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if first[0] == '{' {
+		err = s.replayRecords(r)
+	} else {
+		err = s.replayLegacy(r)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+func (s *MemoryStorage) replayRecords(r *bufio.Reader) error {
+	header := true
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("storage: dropped torn record %q", line)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if header {
+			var h fileHeader
+			err = json.Unmarshal(line, &h)
+			if err != nil {
+				return err
+			}
+			if h.Format != fileFormat || h.Version < 2 || h.Version > fileVersion {
+				return fmt.Errorf("unsupported file format %q version %d", h.Format, h.Version)
+			}
+			if h.Seq > s.replayedSeq {
+				s.replayedSeq = h.Seq
+			}
+			header = false
+			continue
+		}
+
+		var rec fileRecord
+		err = json.Unmarshal(line, &rec)
+		if err != nil {
+			return err
+		}
+		// Records of version 2 files have no Seq and are always applied.
+		if rec.Seq != 0 && rec.Seq <= s.replayedSeq {
+			continue
+		}
+		err = s.applyRecord(rec)
+		if err != nil {
+			return err
+		}
+		if rec.Seq > s.replayedSeq {
+			s.replayedSeq = rec.Seq
+		}
+	}
+}
+
+func (s *MemoryStorage) applyRecord(rec fileRecord) error {
+	switch rec.Op {
+	case fileOpAdd:
+		ml := &memoryLink{OriginalURL: rec.OriginalURL, UserID: rec.UserID, Deleted: rec.Deleted}
+		if rec.CreatedAt != nil {
+			ml.CreatedAt = *rec.CreatedAt
+		}
+		if rec.ExpiresAt != nil {
+			ml.ExpiresAt = *rec.ExpiresAt
+		}
+		if rec.DeletedAt != nil {
+			ml.DeletedAt = *rec.DeletedAt
+		}
+		ml.Clicks = rec.Clicks
+		for _, fv := range rec.History {
+			v := LinkVersion{Version: fv.Version, OriginalURL: fv.OriginalURL}
+			if fv.CreatedAt != nil {
+				v.CreatedAt = *fv.CreatedAt
+			}
+			ml.History = append(ml.History, v)
+		}
+		s.restore(rec.ID, ml)
+	case fileOpDelete:
+		var at time.Time
+		if rec.DeletedAt != nil {
+			at = *rec.DeletedAt
+		}
+		unlock := s.lockAll()
+		s.deleteUserURLs(rec.IDs, rec.UserID, at)
+		unlock()
+	case fileOpRestore:
+		unlock := s.lockAll()
+		s.restoreUserURLs(rec.IDs, rec.UserID)
+		unlock()
+	case fileOpUpdate:
+		var at time.Time
+		if rec.CreatedAt != nil {
+			at = *rec.CreatedAt
+		}
+		unlock := s.lockAll()
+		if ml := s.shards[shardIndex(rec.ID)].links[rec.ID]; ml != nil {
+			s.updateURL(rec.ID, ml, rec.OriginalURL, at)
+		}
+		unlock()
+	case fileOpClicks:
+		sh := &s.shards[shardIndex(rec.ID)]
+		sh.mu.Lock()
+		if ml := sh.links[rec.ID]; ml != nil {
+			ml.addClicks(rec.Clicks)
+		}
+		sh.mu.Unlock()
+	case fileOpPurge:
+		unlock := s.lockAll()
+		for _, ID := range rec.IDs {
+			s.remove(ID)
+		}
+		unlock()
+	default:
+		return fmt.Errorf("unknown record %q", rec.Op)
+	}
+
+	return nil
+}
+
+// replayLegacy reads the headerless CSV of format version 1: the <id>,<url>
+// lines written by MemoryStorage.CleanUp, and the add,<id>,<url>,<user> and
+// delete,<user>,<id>... lines of the first version of the log.
+func (s *MemoryStorage) replayLegacy(r *bufio.Reader) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	var pending []string
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if pending != nil {
+			err = s.applyLegacy(pending)
+			if err != nil {
+				return err
+			}
+		}
+		pending = rec
+	}
+
+	if pending != nil {
+		// csv.Reader doesn't tell whether the last line was complete, so a
+		// malformed last record is taken for one torn by a crash.
+		if err := s.applyLegacy(pending); err != nil {
+			log.Printf("storage: dropped torn record %q", pending)
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStorage) applyLegacy(rec []string) error {
+	switch {
+	case len(rec) == 2:
+		s.restore(rec[0], &memoryLink{OriginalURL: rec[1]})
+	case len(rec) == 4 && rec[0] == fileOpAdd:
+		s.restore(rec[1], &memoryLink{OriginalURL: rec[2], UserID: rec[3]})
+	case len(rec) >= 3 && rec[0] == fileOpDelete:
+		unlock := s.lockAll()
+		s.deleteUserURLs(rec[2:], rec[1], time.Time{})
+		unlock()
+	default:
+		return fmt.Errorf("unknown record %q", rec)
+	}
+
+	return nil
+}
+
+func (s *MemoryStorage) runFileMaintenance(c app.Config) {
+	defer s.maintenance.Done()
+
+	var syncC, compactC <-chan time.Time
+	if s.log.policy == SyncInterval && c.FileSyncInterval > 0 {
+		t := time.NewTicker(c.FileSyncInterval)
+		defer t.Stop()
+		syncC = t.C
+	}
+	if c.FileCompactInterval > 0 {
+		t := time.NewTicker(c.FileCompactInterval)
+		defer t.Stop()
+		compactC = t.C
+	}
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-syncC:
+			if err := s.log.sync(); err != nil {
+				log.Printf("storage: sync %s: %v", s.FilePath, err)
+			}
+		case <-compactC:
+			if err := s.compact(); err != nil {
+				log.Printf("storage: compact %s: %v", s.FilePath, err)
+			}
+		}
+	}
+}
+
+// initFileStorage restores a MemoryStorage from the snapshot and log kept at
+// path and keeps appending its changes to the log from then on.
+func initFileStorage(c app.Config, path string) (*MemoryStorage, error) {
+	switch c.FileSyncPolicy {
+	case SyncAlways, SyncInterval, SyncNever:
+	default:
+		return nil, fmt.Errorf("unknown file sync policy %q", c.FileSyncPolicy)
+	}
+
+	memSt := NewMemoryStorage()
+	memSt.FilePath = path
+	memSt.DedupScope = c.DedupScope
+
+	for _, p := range []string{snapshotPath(path), rotatedLogPath(path), path} {
+		err := memSt.replay(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := openFileLog(path, c.FileSyncPolicy, memSt.replayedSeq)
+	if err != nil {
+		return nil, err
+	}
+	memSt.log = l
+
+	// Start from a clean log: it drops torn records and rewrites files of
+	// older format versions in the current one.
+	err = memSt.compact()
+	if err != nil {
+		l.close()
+		return nil, err
+	}
+
+	memSt.stop = make(chan struct{})
+	memSt.maintenance.Add(1)
+	go memSt.runFileMaintenance(c)
+
+	return memSt, nil
+}
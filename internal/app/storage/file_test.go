@@ -0,0 +1,437 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testFileHeader = `{"format":"shortener-links","version":3}` + "\n"
+
+func fileTestConfig() app.Config {
+	return app.Config{FileSyncPolicy: SyncAlways}
+}
+
+// openFileStorage opens the file storage at path and closes it when the
+// test ends.
+func openFileStorage(t *testing.T, c app.Config, path string) *MemoryStorage {
+	s, err := initFileStorage(c, path)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.CleanUp(context.Background(), c) })
+	return s
+}
+
+// crash stops s the way a killed process would: the maintenance ends and
+// the log is closed, but no snapshot is written. CleanUp does nothing
+// afterwards.
+func crash(s *MemoryStorage) {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return
+	}
+	close(s.stop)
+	s.maintenance.Wait()
+	s.log.close()
+}
+
+func TestFileStorageReplaysLogAfterCrash(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.csv")
+
+	s := openFileStorage(t, fileTestConfig(), path)
+	_, err := s.AddURLBatch(ctx, []ShortLink{
+		{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"},
+		{ID: "b", OriginalURL: "https://example.org/b", UserID: "u2"},
+	})
+	assert.NoError(t, err)
+	// The process is gone without writing a snapshot.
+	crash(s)
+
+	restored := openFileStorage(t, fileTestConfig(), path)
+
+	URL, err := restored.GetURLByID(ctx, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.org/b", URL)
+
+	links, err := restored.GetUserURLs(ctx, "u1")
+	assert.NoError(t, err)
+	assert.Equal(t, []ShortLink{{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"}}, links)
+}
+
+func TestFileStorageDropsTornRecord(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.csv")
+
+	err := os.WriteFile(path, []byte(testFileHeader+
+		`{"op":"add","id":"a","original_url":"https://example.org/a","user_id":"u1"}`+"\n"+
+		`{"op":"add","id":"b","original_url":"https://exa`), 0664)
+	assert.NoError(t, err)
+
+	s := openFileStorage(t, fileTestConfig(), path)
+
+	URL, err := s.GetURLByID(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.org/a", URL)
+
+	URL, err = s.GetURLByID(ctx, "b")
+	assert.NoError(t, err)
+	assert.Empty(t, URL)
+
+	// The torn record is gone from the log, so new records start clean.
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "c", OriginalURL: "https://example.org/c", UserID: "u1"}))
+	crash(s)
+	restored := openFileStorage(t, fileTestConfig(), path)
+	_, err = restored.GetURLByID(ctx, "c")
+	assert.NoError(t, err)
+}
+
+func TestFileStorageRejectsCorruptedLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.csv")
+
+	err := os.WriteFile(path, []byte(testFileHeader+
+		`{"op":"add","id":"a","original_url":"https://exa`+"\n"+
+		`{"op":"add","id":"b","original_url":"https://example.org/b","user_id":"u1"}`+"\n"), 0664)
+	assert.NoError(t, err)
+
+	_, err = initFileStorage(fileTestConfig(), path)
+	assert.Error(t, err)
+}
+
+func TestFileStorageCompaction(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.csv")
+
+	s := openFileStorage(t, fileTestConfig(), path)
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"}))
+	assert.NoError(t, s.compact())
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, testFileHeader, string(content))
+
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "b", OriginalURL: "https://example.org/b", UserID: "u1"}))
+	crash(s)
+
+	restored := openFileStorage(t, fileTestConfig(), path)
+
+	for _, ID := range []string{"a", "b"} {
+		_, err = restored.GetURLByID(ctx, ID)
+		assert.NoError(t, err)
+	}
+}
+
+func TestFileStorageSkipsRecordsReflectedInSnapshot(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.csv")
+
+	s := openFileStorage(t, fileTestConfig(), path)
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"}))
+	assert.NoError(t, s.AddClicks(ctx, []Click{{LinkID: "a", At: time.Now()}}))
+	_, err := s.UpdateURL(ctx, "a", "u1", "https://example.org/b")
+	assert.NoError(t, err)
+
+	// The compaction is cut short by a crash after the snapshot is written
+	// but before the rotated log is removed.
+	logged, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, s.compact())
+	assert.NoError(t, os.WriteFile(rotatedLogPath(path), logged, 0664))
+	assert.NoError(t, s.AddClicks(ctx, []Click{{LinkID: "a", At: time.Now()}}))
+	crash(s)
+
+	// Once restored from the leftovers and once more from the snapshot.
+	for i := 0; i < 2; i++ {
+		restored := openFileStorage(t, fileTestConfig(), path)
+
+		stats, err := restored.GetClickStats(ctx, "a", time.Now().AddDate(0, 0, -1))
+		assert.NoError(t, err)
+		assert.EqualValues(t, 2, stats.Total)
+		history, err := restored.GetURLHistory(ctx, "a")
+		assert.NoError(t, err)
+		assert.Len(t, history, 2)
+
+		restored.CleanUp(ctx, fileTestConfig())
+	}
+
+	// The numbering goes on after a restart.
+	restored := openFileStorage(t, fileTestConfig(), path)
+	assert.NoError(t, restored.AddClicks(ctx, []Click{{LinkID: "a", At: time.Now()}}))
+	crash(restored)
+	restored = openFileStorage(t, fileTestConfig(), path)
+	stats, err := restored.GetClickStats(ctx, "a", time.Now().AddDate(0, 0, -1))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, stats.Total)
+}
+
+func TestFileStorageReadsUnnumberedRecords(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.csv")
+
+	err := os.WriteFile(path, []byte(`{"format":"shortener-links","version":2}`+"\n"+
+		`{"op":"add","id":"a","original_url":"https://example.org/a","user_id":"u1"}`+"\n"+
+		`{"op":"clicks","id":"a","clicks":{"2022-03-01":2}}`+"\n"+
+		`{"op":"clicks","id":"a","clicks":{"2022-03-01":3}}`+"\n"), 0664)
+	assert.NoError(t, err)
+
+	s := openFileStorage(t, fileTestConfig(), path)
+
+	stats, err := s.GetClickStats(ctx, "a", time.Time{})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, stats.Total)
+}
+
+func TestFileStorageUpgradesLegacyCSV(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.csv")
+
+	err := os.WriteFile(path, []byte("a,https://example.org/a\nb,https://example.org/b\n"), 0664)
+	assert.NoError(t, err)
+
+	s := openFileStorage(t, fileTestConfig(), path)
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "c", OriginalURL: "https://example.org/c", UserID: "u1"}))
+	s.CleanUp(ctx, fileTestConfig())
+
+	snapshot, err := os.ReadFile(snapshotPath(path))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(snapshot), strings.TrimSuffix(testFileHeader, "}\n")))
+
+	restored := openFileStorage(t, fileTestConfig(), path)
+
+	for _, ID := range []string{"a", "b", "c"} {
+		_, err = restored.GetURLByID(ctx, ID)
+		assert.NoError(t, err)
+	}
+	links, err := restored.GetUserURLs(ctx, "u1")
+	assert.NoError(t, err)
+	assert.Equal(t, []ShortLink{{ID: "c", OriginalURL: "https://example.org/c", UserID: "u1"}}, links)
+}
+
+func TestFileStoragePersistsDeletion(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.csv")
+
+	s := openFileStorage(t, fileTestConfig(), path)
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"}))
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "b", OriginalURL: "https://example.org/b", UserID: "u1"}))
+	_, err := s.DeleteUserURLs(ctx, []string{"a"}, "u1")
+	assert.NoError(t, err)
+
+	crash(s)
+	// Once restored from the log and once more from the snapshot.
+	for i := 0; i < 2; i++ {
+		restored := openFileStorage(t, fileTestConfig(), path)
+
+		_, err = restored.GetURLByID(ctx, "a")
+		var rde *RecordSoftDeletedError
+		assert.True(t, errors.As(err, &rde))
+		_, err = restored.GetURLByID(ctx, "b")
+		assert.NoError(t, err)
+
+		restored.CleanUp(ctx, fileTestConfig())
+	}
+}
+
+func TestFileStorageLogsOnlyOwnedDeletions(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.csv")
+
+	s := openFileStorage(t, fileTestConfig(), path)
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"}))
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "b", OriginalURL: "https://example.org/b", UserID: "u2"}))
+
+	deleted, err := s.DeleteUserURLs(ctx, []string{"a", "b", "missing"}, "u1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, deleted)
+	// Deleting again changes nothing, so nothing is logged.
+	_, err = s.DeleteUserURLs(ctx, []string{"a"}, "u1")
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	var deletes []fileRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n")[1:] {
+		var rec fileRecord
+		assert.NoError(t, json.Unmarshal([]byte(line), &rec))
+		if rec.Op == fileOpDelete {
+			deletes = append(deletes, rec)
+		}
+	}
+	if assert.Len(t, deletes, 1) {
+		assert.Equal(t, []string{"a"}, deletes[0].IDs)
+	}
+}
+
+func TestFileStoragePersistsRestoreAndPurge(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.csv")
+
+	s := openFileStorage(t, fileTestConfig(), path)
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"}))
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "b", OriginalURL: "https://example.org/b", UserID: "u1"}))
+	_, err := s.DeleteUserURLs(ctx, []string{"a", "b"}, "u1")
+	assert.NoError(t, err)
+	IDs, err := s.RestoreUserURLs(ctx, []string{"a"}, "u1", time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, IDs)
+	n, err := s.PurgeDeleted(ctx, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	crash(s)
+	// Once restored from the log and once more from the snapshot.
+	for i := 0; i < 2; i++ {
+		restored := openFileStorage(t, fileTestConfig(), path)
+
+		URL, err := restored.GetURLByID(ctx, "a")
+		assert.NoError(t, err)
+		assert.Equal(t, "https://example.org/a", URL)
+		link, err := restored.GetLinkByID(ctx, "b")
+		assert.NoError(t, err)
+		assert.Equal(t, ShortLink{}, link)
+
+		restored.CleanUp(ctx, fileTestConfig())
+	}
+}
+
+func TestFileStoragePersistsURLUpdates(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.csv")
+
+	s := openFileStorage(t, fileTestConfig(), path)
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"}))
+	version, err := s.UpdateURL(ctx, "a", "u1", "https://example.org/b")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, version)
+	want, err := s.GetURLHistory(ctx, "a")
+	assert.NoError(t, err)
+
+	crash(s)
+	// Once restored from the log and once more from the snapshot.
+	for i := 0; i < 2; i++ {
+		restored := openFileStorage(t, fileTestConfig(), path)
+
+		URL, err := restored.GetURLByID(ctx, "a")
+		assert.NoError(t, err)
+		assert.Equal(t, "https://example.org/b", URL)
+		history, err := restored.GetURLHistory(ctx, "a")
+		assert.NoError(t, err)
+		assert.Equal(t, want, history)
+		ID, err := restored.GetURLByOriginalURL(ctx, "https://example.org/a", "u1")
+		assert.NoError(t, err)
+		assert.Empty(t, ID)
+
+		restored.CleanUp(ctx, fileTestConfig())
+	}
+}
+
+func TestFileStorageRekeysOnDedupScopeChange(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.csv")
+	c := fileTestConfig()
+	c.DedupScope = DedupNone
+
+	s := openFileStorage(t, c, path)
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"}))
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "b", OriginalURL: "https://example.org/a", UserID: "u2"}))
+	s.CleanUp(ctx, c)
+
+	c.DedupScope = DedupGlobal
+	restored := openFileStorage(t, c, path)
+
+	for _, ID := range []string{"a", "b"} {
+		URL, err := restored.GetURLByID(ctx, ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "https://example.org/a", URL)
+	}
+	ID, err := restored.GetURLByOriginalURL(ctx, "https://example.org/a", "u3")
+	assert.NoError(t, err)
+	assert.Contains(t, []string{"a", "b"}, ID)
+	err = restored.AddURL(ctx, ShortLink{ID: "c", OriginalURL: "https://example.org/a", UserID: "u3"})
+	var rde *RecordDuplicateError
+	assert.ErrorAs(t, err, &rde)
+}
+
+func TestFileStoragePersistsExpiryAndPurge(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.csv")
+	expiresAt := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+
+	s := openFileStorage(t, fileTestConfig(), path)
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1", ExpiresAt: expiresAt}))
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "b", OriginalURL: "https://example.org/b", UserID: "u1", ExpiresAt: time.Now().Add(-time.Hour)}))
+	n, err := s.PurgeExpired(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	crash(s)
+	// Once restored from the log and once more from the snapshot.
+	for i := 0; i < 2; i++ {
+		restored := openFileStorage(t, fileTestConfig(), path)
+
+		links, err := restored.GetUserURLs(ctx, "u1")
+		assert.NoError(t, err)
+		assert.Equal(t, []ShortLink{{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1", ExpiresAt: expiresAt}}, links)
+
+		restored.CleanUp(ctx, fileTestConfig())
+	}
+}
+
+// TestFileStorageDropsClickDetails checks that only the counts of clicks
+// reach the file: the memory and file storages do not keep click details.
+func TestFileStorageDropsClickDetails(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.csv")
+	day := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	click := Click{LinkID: "a", At: day.Add(time.Hour), Referrer: "https://referrer.example", UserAgent: "test-agent/1.0", IPHash: "ip-hash"}
+
+	s := openFileStorage(t, fileTestConfig(), path)
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"}))
+	assert.NoError(t, s.AddClicks(ctx, []Click{click, click}))
+	stats, err := s.GetClickStats(ctx, "a", day)
+	assert.NoError(t, err)
+	assert.Equal(t, ClickStats{Total: 2, Daily: []DailyClicks{{Day: day, Clicks: 2}}}, stats)
+
+	// Neither in the log nor in the snapshot CleanUp folds it into.
+	logData, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	s.CleanUp(ctx, fileTestConfig())
+	snapshotData, err := os.ReadFile(snapshotPath(path))
+	assert.NoError(t, err)
+	for _, data := range []string{string(logData), string(snapshotData)} {
+		assert.Contains(t, data, `"clicks"`)
+		for _, detail := range []string{click.Referrer, click.UserAgent, click.IPHash} {
+			assert.NotContains(t, data, detail)
+		}
+	}
+}
+
+func TestFileStoragePersistsClicks(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.csv")
+	day := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	s := openFileStorage(t, fileTestConfig(), path)
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"}))
+	assert.NoError(t, s.AddClicks(ctx, []Click{{LinkID: "a", At: day.Add(time.Hour)}, {LinkID: "a", At: day.Add(2 * time.Hour)}}))
+
+	crash(s)
+	// Once restored from the log and once more from the snapshot.
+	for i := 0; i < 2; i++ {
+		restored := openFileStorage(t, fileTestConfig(), path)
+
+		stats, err := restored.GetClickStats(ctx, "a", day)
+		assert.NoError(t, err)
+		assert.Equal(t, ClickStats{Total: 2, Daily: []DailyClicks{{Day: day, Clicks: 2}}}, stats)
+
+		restored.CleanUp(ctx, fileTestConfig())
+	}
+}
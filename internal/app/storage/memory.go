@@ -0,0 +1,879 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app"
+)
+
+// memoryShards is the number of independently locked partitions of a
+// MemoryStorage. Every key (short ID, dedup key or user ID) is mapped to a
+// shard by its hash, so unrelated requests rarely contend for the same lock.
+const memoryShards = 32
+
+// memoryShard holds the part of each index whose keys hash to it: links by
+// short ID, the reverse index from dedup key (see dedupKey) to short ID, and
+// the short IDs owned by each user. The reverse index is updated together
+// with links, so duplicate checks and GetURLByOriginalURL never scan the
+// whole storage.
+type memoryShard struct {
+	mu        sync.RWMutex
+	links     map[string]*memoryLink
+	originals map[string]string
+	userLinks map[string][]string
+}
+
+type memoryLink struct {
+	OriginalURL string
+	UserID      string
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	Deleted     bool
+	DeletedAt   time.Time
+	Clicks      dayCounts
+	// History is empty until the link is first updated.
+	History []LinkVersion
+}
+
+// dayCounts counts clicks by their UTC day formatted with clickDayLayout.
+type dayCounts map[string]int64
+
+func (dc dayCounts) add(other dayCounts) {
+	for day, n := range other {
+		dc[day] += n
+	}
+}
+
+// version returns the number of the current version of the link.
+func (ml *memoryLink) version() int {
+	if len(ml.History) == 0 {
+		return 1
+	}
+	return ml.History[len(ml.History)-1].Version
+}
+
+func (ml *memoryLink) addClicks(counts dayCounts) {
+	if ml.Clicks == nil {
+		ml.Clicks = make(dayCounts, len(counts))
+	}
+	ml.Clicks.add(counts)
+}
+
+// MemoryStorage keeps all links in memory. When FilePath is set every change
+// is also appended to the log at FilePath (see fileLog), so the storage can
+// be restored after a restart or a crash.
+type MemoryStorage struct {
+	shards   [memoryShards]memoryShard
+	FilePath string
+	// DedupScope is one of the Dedup scopes.
+	DedupScope string
+
+	log *fileLog
+	// replayedSeq is the Seq of the last log record replayed or reflected
+	// by the replayed snapshot.
+	replayedSeq uint64
+	stop        chan struct{}
+	maintenance sync.WaitGroup
+	closed      int32
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	s := &MemoryStorage{}
+	for i := range s.shards {
+		s.shards[i].links = make(map[string]*memoryLink)
+		s.shards[i].originals = make(map[string]string)
+		s.shards[i].userLinks = make(map[string][]string)
+	}
+	return s
+}
+
+// shardIndex hashes key with 32-bit FNV-1a.
+func shardIndex(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % memoryShards)
+}
+
+// lockShards write-locks the shards of the original URL, short ID and user
+// of a link in ascending order, which keeps operations spanning several
+// shards free of deadlocks. It returns the matching unlock function.
+func (s *MemoryStorage) lockShards(a, b, c int) func() {
+	if a > b {
+		a, b = b, a
+	}
+	if b > c {
+		b, c = c, b
+	}
+	if a > b {
+		a, b = b, a
+	}
+
+	s.shards[a].mu.Lock()
+	if b != a {
+		s.shards[b].mu.Lock()
+	}
+	if c != b {
+		s.shards[c].mu.Lock()
+	}
+
+	return func() {
+		if c != b {
+			s.shards[c].mu.Unlock()
+		}
+		if b != a {
+			s.shards[b].mu.Unlock()
+		}
+		s.shards[a].mu.Unlock()
+	}
+}
+
+// dedupKey returns the dedup key of a link of userID for originalURL and the
+// shard holding it.
+func (s *MemoryStorage) dedupKey(userID, originalURL string) (string, int, bool) {
+	key, ok := dedupKey(s.DedupScope, userID, originalURL)
+	return key, shardIndex(key), ok
+}
+
+// lockAll write-locks every shard, for the rare operations which may touch
+// any of them. It returns the matching unlock function.
+func (s *MemoryStorage) lockAll() func() {
+	for i := range s.shards {
+		s.shards[i].mu.Lock()
+	}
+
+	return func() {
+		for i := len(s.shards) - 1; i >= 0; i-- {
+			s.shards[i].mu.Unlock()
+		}
+	}
+}
+
+func (s *MemoryStorage) GetURLByID(ctx context.Context, ID string) (string, error) {
+	if s.isClosed() {
+		return "", ErrStorageClosed
+	}
+
+	sh := &s.shards[shardIndex(ID)]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	item := sh.links[ID]
+	if item == nil {
+		return "", nil
+	}
+	if item.Deleted {
+		return "", &RecordSoftDeletedError{ID}
+	}
+	if isExpired(item.ExpiresAt, time.Now()) {
+		return "", &RecordExpiredError{ID}
+	}
+
+	return item.OriginalURL, nil
+}
+
+func (s *MemoryStorage) GetLinkByID(ctx context.Context, ID string) (ShortLink, error) {
+	if s.isClosed() {
+		return ShortLink{}, ErrStorageClosed
+	}
+
+	sh := &s.shards[shardIndex(ID)]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	item := sh.links[ID]
+	if item == nil {
+		return ShortLink{}, nil
+	}
+
+	return ShortLink{ID: ID, OriginalURL: item.OriginalURL, UserID: item.UserID, ExpiresAt: item.ExpiresAt}, nil
+}
+
+func (s *MemoryStorage) GetURLByOriginalURL(ctx context.Context, OriginalURL string, userID string) (string, error) {
+	if s.isClosed() {
+		return "", ErrStorageClosed
+	}
+
+	key, o, ok := s.dedupKey(userID, OriginalURL)
+	if !ok {
+		return "", nil
+	}
+	sh := &s.shards[o]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	return sh.originals[key], nil
+}
+
+func (s *MemoryStorage) GetUserURLs(ctx context.Context, userID string) ([]ShortLink, error) {
+	if s.isClosed() {
+		return nil, ErrStorageClosed
+	}
+
+	var res []ShortLink
+
+	sh := &s.shards[shardIndex(userID)]
+	sh.mu.RLock()
+	userURLs := make([]string, len(sh.userLinks[userID]))
+	copy(userURLs, sh.userLinks[userID])
+	sh.mu.RUnlock()
+
+	// Deleted links are listed too, the same way DBStorage does.
+	for _, shortID := range userURLs {
+		sh := &s.shards[shardIndex(shortID)]
+		sh.mu.RLock()
+		link := ShortLink{ID: shortID, UserID: userID}
+		if item := sh.links[shortID]; item != nil {
+			link.OriginalURL = item.OriginalURL
+			link.ExpiresAt = item.ExpiresAt
+		}
+		sh.mu.RUnlock()
+
+		res = append(res, link)
+	}
+
+	return res, nil
+}
+
+// AddURL stores link. An expired link it duplicates is purged to make room
+// for it.
+func (s *MemoryStorage) AddURL(ctx context.Context, link ShortLink) error {
+	if s.isClosed() {
+		return ErrStorageClosed
+	}
+
+	err := s.addURL(link)
+	var rde *RecordDuplicateError
+	if errors.As(err, &rde) {
+		key, _, _ := s.dedupKey(link.UserID, link.OriginalURL)
+		purged, purgeErr := s.purgeExpiredDuplicate(key)
+		if purgeErr != nil {
+			return purgeErr
+		}
+		if purged {
+			err = s.addURL(link)
+		}
+	}
+
+	return err
+}
+
+func (s *MemoryStorage) addURL(link ShortLink) error {
+	key, o, dedup := s.dedupKey(link.UserID, link.OriginalURL)
+	i, u := shardIndex(link.ID), shardIndex(link.UserID)
+	unlock := s.lockShards(o, i, u)
+	defer unlock()
+
+	if _, ok := s.shards[o].originals[key]; ok && dedup {
+		return &RecordDuplicateError{param: "OriginalID", value: link.OriginalURL}
+	}
+	if _, ok := s.shards[i].links[link.ID]; ok {
+		return &RecordIDCollisionError{link.ID}
+	}
+
+	ml := newMemoryLink(link, time.Now().UTC())
+	if s.log != nil {
+		err := s.log.append(linkRecord(link.ID, ml))
+		if err != nil {
+			return err
+		}
+	}
+
+	s.insert(link.ID, ml, o, i, u)
+
+	return nil
+}
+
+// restore adds a link read back from the file storage. Links that are
+// already known are skipped, which makes replaying a record twice harmless.
+// A link duplicating an earlier one, which happens when the file was written
+// under a narrower dedup scope, is kept without a dedup key, the way the SQL
+// storages do.
+func (s *MemoryStorage) restore(ID string, ml *memoryLink) {
+	_, o, _ := s.dedupKey(ml.UserID, ml.OriginalURL)
+	i, u := shardIndex(ID), shardIndex(ml.UserID)
+	unlock := s.lockShards(o, i, u)
+	defer unlock()
+
+	if _, ok := s.shards[i].links[ID]; ok {
+		return
+	}
+
+	s.insert(ID, ml, o, i, u)
+}
+
+// purgeExpiredDuplicate purges the link holding the dedup key if it has
+// expired, and reports whether it did.
+func (s *MemoryStorage) purgeExpiredDuplicate(key string) (bool, error) {
+	unlock := s.lockAll()
+	defer unlock()
+
+	ID, ok := s.shards[shardIndex(key)].originals[key]
+	if !ok || !isExpired(s.shards[shardIndex(ID)].links[ID].ExpiresAt, time.Now()) {
+		return false, nil
+	}
+
+	if s.log != nil {
+		err := s.log.append(fileRecord{Op: fileOpPurge, IDs: []string{ID}})
+		if err != nil {
+			return false, err
+		}
+	}
+	s.remove(ID)
+
+	return true, nil
+}
+
+func newMemoryLink(link ShortLink, now time.Time) *memoryLink {
+	ml := &memoryLink{OriginalURL: link.OriginalURL, UserID: link.UserID, CreatedAt: now}
+	if !link.ExpiresAt.IsZero() {
+		ml.ExpiresAt = link.ExpiresAt.UTC()
+	}
+	return ml
+}
+
+// insert stores a link; the caller holds the locks of the shards o of its
+// dedup key, i of ID and u of its user. The link takes its dedup key only if
+// no other link holds it.
+func (s *MemoryStorage) insert(ID string, ml *memoryLink, o, i, u int) {
+	s.shards[i].links[ID] = ml
+	if key, _, ok := s.dedupKey(ml.UserID, ml.OriginalURL); ok {
+		if _, taken := s.shards[o].originals[key]; !taken {
+			s.shards[o].originals[key] = ID
+		}
+	}
+	s.shards[u].userLinks[ml.UserID] = append(s.shards[u].userLinks[ml.UserID], ID)
+}
+
+// remove drops the link stored under ID from every index; the caller holds
+// the locks of all shards.
+func (s *MemoryStorage) remove(ID string) {
+	sh := &s.shards[shardIndex(ID)]
+	ml := sh.links[ID]
+	if ml == nil {
+		return
+	}
+	delete(sh.links, ID)
+
+	key, o, _ := s.dedupKey(ml.UserID, ml.OriginalURL)
+	if s.shards[o].originals[key] == ID {
+		delete(s.shards[o].originals, key)
+	}
+
+	u := &s.shards[shardIndex(ml.UserID)]
+	IDs := u.userLinks[ml.UserID]
+	for n, userID := range IDs {
+		if userID == ID {
+			// Copy rather than shift in place: GetUserURLs may hold a copy of
+			// the old slice header.
+			IDs = append(IDs[:n:n], IDs[n+1:]...)
+			break
+		}
+	}
+	if len(IDs) == 0 {
+		delete(u.userLinks, ml.UserID)
+	} else {
+		u.userLinks[ml.UserID] = IDs
+	}
+}
+
+// AddURLBatch checks the whole batch before storing any of it. A batch may
+// touch every shard, so it holds all of them locked while it runs. Expired
+// links duplicated by the batch are purged.
+func (s *MemoryStorage) AddURLBatch(ctx context.Context, links []ShortLink) ([]BatchResult, error) {
+	if s.isClosed() {
+		return nil, ErrStorageClosed
+	}
+
+	unlock := s.lockAll()
+	defer unlock()
+
+	res := make([]BatchResult, len(links))
+	batchKeys := make(map[string]string)
+	batchIDs := make(map[string]struct{})
+	created := make([]int, 0, len(links))
+	var purged []string
+	recs := make([]fileRecord, 0, len(links))
+	now := time.Now().UTC()
+
+	for n, link := range links {
+		key, o, dedup := s.dedupKey(link.UserID, link.OriginalURL)
+		if ID, ok := s.shards[o].originals[key]; ok && dedup {
+			if !isExpired(s.shards[shardIndex(ID)].links[ID].ExpiresAt, now) {
+				res[n] = BatchResult{ID: ID, Status: BatchExisting}
+				continue
+			}
+			purged = append(purged, ID)
+		}
+		if ID, ok := batchKeys[key]; ok && dedup {
+			res[n] = BatchResult{ID: ID, Status: BatchExisting}
+			continue
+		}
+		_, taken := s.shards[shardIndex(link.ID)].links[link.ID]
+		if _, ok := batchIDs[link.ID]; ok || taken {
+			return nil, &RecordIDCollisionError{link.ID}
+		}
+
+		batchKeys[key] = link.ID
+		batchIDs[link.ID] = struct{}{}
+		res[n] = BatchResult{ID: link.ID, Status: BatchCreated}
+		created = append(created, n)
+		recs = append(recs, linkRecord(link.ID, newMemoryLink(link, now)))
+	}
+
+	if len(purged) > 0 {
+		recs = append([]fileRecord{{Op: fileOpPurge, IDs: purged}}, recs...)
+	}
+	if s.log != nil && len(recs) > 0 {
+		err := s.log.append(recs...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, ID := range purged {
+		s.remove(ID)
+	}
+	for _, n := range created {
+		link := links[n]
+		_, o, _ := s.dedupKey(link.UserID, link.OriginalURL)
+		s.insert(link.ID, newMemoryLink(link, now), o, shardIndex(link.ID), shardIndex(link.UserID))
+	}
+
+	return res, nil
+}
+
+// PurgeExpired removes the links which expired at or before before.
+func (s *MemoryStorage) PurgeExpired(ctx context.Context, before time.Time) (int64, error) {
+	if s.isClosed() {
+		return 0, ErrStorageClosed
+	}
+
+	unlock := s.lockAll()
+	defer unlock()
+
+	var IDs []string
+	for i := range s.shards {
+		for ID, ml := range s.shards[i].links {
+			if isExpired(ml.ExpiresAt, before) {
+				IDs = append(IDs, ID)
+			}
+		}
+	}
+	if len(IDs) == 0 {
+		return 0, nil
+	}
+
+	if s.log != nil {
+		err := s.log.append(fileRecord{Op: fileOpPurge, IDs: IDs})
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, ID := range IDs {
+		s.remove(ID)
+	}
+
+	return int64(len(IDs)), nil
+}
+
+// AddClicks keeps the daily click counts of each link only. The referrer,
+// user agent and IP hash of single clicks are dropped, in memory as well as
+// in the file log, see Repository.AddClicks.
+func (s *MemoryStorage) AddClicks(ctx context.Context, clicks []Click) error {
+	if s.isClosed() {
+		return ErrStorageClosed
+	}
+
+	byLink := make(map[string]dayCounts)
+	for _, click := range clicks {
+		counts := byLink[click.LinkID]
+		if counts == nil {
+			counts = make(dayCounts)
+			byLink[click.LinkID] = counts
+		}
+		counts[click.At.UTC().Format(clickDayLayout)]++
+	}
+
+	for ID, counts := range byLink {
+		err := s.addClicks(ID, counts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStorage) addClicks(ID string, counts dayCounts) error {
+	sh := &s.shards[shardIndex(ID)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	ml := sh.links[ID]
+	if ml == nil {
+		return nil
+	}
+	if s.log != nil {
+		err := s.log.append(fileRecord{Op: fileOpClicks, ID: ID, Clicks: counts})
+		if err != nil {
+			return err
+		}
+	}
+	ml.addClicks(counts)
+
+	return nil
+}
+
+func (s *MemoryStorage) GetClickStats(ctx context.Context, ID string, since time.Time) (ClickStats, error) {
+	if s.isClosed() {
+		return ClickStats{}, ErrStorageClosed
+	}
+
+	var res ClickStats
+	from := since.UTC().Format(clickDayLayout)
+
+	sh := &s.shards[shardIndex(ID)]
+	sh.mu.RLock()
+	if ml := sh.links[ID]; ml != nil {
+		for day, n := range ml.Clicks {
+			res.Total += n
+			if day < from {
+				continue
+			}
+			at, err := time.Parse(clickDayLayout, day)
+			if err != nil {
+				continue
+			}
+			res.Daily = append(res.Daily, DailyClicks{Day: at, Clicks: n})
+		}
+	}
+	sh.mu.RUnlock()
+
+	sort.Slice(res.Daily, func(i, j int) bool { return res.Daily[i].Day.Before(res.Daily[j].Day) })
+
+	return res, nil
+}
+
+func (s *MemoryStorage) GetServiceStats(ctx context.Context) (ServiceStats, error) {
+	if s.isClosed() {
+		return ServiceStats{}, ErrStorageClosed
+	}
+
+	var res ServiceStats
+	users := make(map[string]struct{})
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		for _, ml := range sh.links {
+			if ml.Deleted {
+				res.Deleted++
+			} else {
+				res.URLs++
+			}
+			if ml.UserID != "" {
+				users[ml.UserID] = struct{}{}
+			}
+			for _, n := range ml.Clicks {
+				res.Clicks += n
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	res.Users = int64(len(users))
+
+	return res, nil
+}
+
+func (s *MemoryStorage) WalkLinkIDs(ctx context.Context, fn func(ID string)) error {
+	if s.isClosed() {
+		return ErrStorageClosed
+	}
+
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		for ID := range sh.links {
+			fn(ID)
+		}
+		sh.mu.RUnlock()
+	}
+
+	return nil
+}
+
+func (s *MemoryStorage) Ping(ctx context.Context) error {
+	if s.isClosed() {
+		return ErrStorageClosed
+	}
+
+	return nil
+}
+
+func (s *MemoryStorage) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) != 0
+}
+
+// CleanUp closes the storage. For the file storage it also stops the
+// background maintenance and folds the log into a final snapshot.
+func (s *MemoryStorage) CleanUp(ctx context.Context, c app.Config) {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) || s.log == nil {
+		return
+	}
+
+	close(s.stop)
+	s.maintenance.Wait()
+
+	err := s.compact()
+	if err != nil {
+		log.Printf("storage: compact %s: %v", s.FilePath, err)
+	}
+	err = s.log.close()
+	if err != nil {
+		log.Printf("storage: close %s: %v", s.FilePath, err)
+	}
+}
+
+func (s *MemoryStorage) DeleteUserURLs(ctx context.Context, IDs []string, userID string) ([]string, error) {
+	if s.isClosed() {
+		return nil, ErrStorageClosed
+	}
+
+	// As in RestoreUserURLs, the links are checked and deleted under the
+	// lock of all shards, so that the logged IDs are exactly the deleted
+	// ones. IDs owned by other users or unknown are skipped, like the UPDATE
+	// of DBStorage does.
+	unlock := s.lockAll()
+	defer unlock()
+
+	var owned, deleting []string
+	seen := make(map[string]struct{}, len(IDs))
+	for _, ID := range IDs {
+		if _, ok := seen[ID]; ok {
+			continue
+		}
+		seen[ID] = struct{}{}
+
+		item := s.shards[shardIndex(ID)].links[ID]
+		if item == nil || item.UserID != userID {
+			continue
+		}
+		owned = append(owned, ID)
+		if !item.Deleted {
+			deleting = append(deleting, ID)
+		}
+	}
+	if len(deleting) == 0 {
+		return owned, nil
+	}
+
+	now := time.Now().UTC()
+	if s.log != nil {
+		err := s.log.append(fileRecord{Op: fileOpDelete, IDs: deleting, UserID: userID, DeletedAt: &now})
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.deleteUserURLs(deleting, userID, now)
+
+	return owned, nil
+}
+
+// deleteUserURLs marks the links of userID among IDs as deleted at at; the
+// caller holds the locks of all shards. Links deleted already keep their
+// deletion time.
+func (s *MemoryStorage) deleteUserURLs(IDs []string, userID string, at time.Time) {
+	for _, ID := range IDs {
+		item := s.shards[shardIndex(ID)].links[ID]
+		if item != nil && item.UserID == userID && !item.Deleted {
+			item.Deleted = true
+			item.DeletedAt = at
+		}
+	}
+}
+
+func (s *MemoryStorage) RestoreUserURLs(ctx context.Context, IDs []string, userID string, deletedSince time.Time) ([]string, error) {
+	if s.isClosed() {
+		return nil, ErrStorageClosed
+	}
+
+	// The links are checked and restored under the lock of all shards, so
+	// that the logged IDs are exactly the restored ones.
+	unlock := s.lockAll()
+	defer unlock()
+
+	var restorable []string
+	seen := make(map[string]struct{}, len(IDs))
+	for _, ID := range IDs {
+		if _, ok := seen[ID]; ok {
+			continue
+		}
+		seen[ID] = struct{}{}
+
+		item := s.shards[shardIndex(ID)].links[ID]
+		if item != nil && item.UserID == userID && item.Deleted && !item.DeletedAt.Before(deletedSince) {
+			restorable = append(restorable, ID)
+		}
+	}
+	if len(restorable) == 0 {
+		return nil, nil
+	}
+
+	if s.log != nil {
+		err := s.log.append(fileRecord{Op: fileOpRestore, IDs: restorable, UserID: userID})
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.restoreUserURLs(restorable, userID)
+
+	return restorable, nil
+}
+
+// restoreUserURLs undoes the deletion of the links of userID among IDs; the
+// caller holds the locks of all shards.
+func (s *MemoryStorage) restoreUserURLs(IDs []string, userID string) {
+	for _, ID := range IDs {
+		item := s.shards[shardIndex(ID)].links[ID]
+		if item != nil && item.UserID == userID {
+			item.Deleted = false
+			item.DeletedAt = time.Time{}
+		}
+	}
+}
+
+// PurgeDeleted removes the links deleted before before. Links deleted by
+// the first version of the file storage have no deletion time and are
+// removed by the first purge.
+func (s *MemoryStorage) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	if s.isClosed() {
+		return 0, ErrStorageClosed
+	}
+
+	unlock := s.lockAll()
+	defer unlock()
+
+	var IDs []string
+	for i := range s.shards {
+		for ID, ml := range s.shards[i].links {
+			if ml.Deleted && ml.DeletedAt.Before(before) {
+				IDs = append(IDs, ID)
+			}
+		}
+	}
+	if len(IDs) == 0 {
+		return 0, nil
+	}
+
+	if s.log != nil {
+		err := s.log.append(fileRecord{Op: fileOpPurge, IDs: IDs})
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, ID := range IDs {
+		s.remove(ID)
+	}
+
+	return int64(len(IDs)), nil
+}
+
+func (s *MemoryStorage) UpdateURL(ctx context.Context, ID string, userID string, originalURL string) (int, error) {
+	if s.isClosed() {
+		return 0, ErrStorageClosed
+	}
+
+	unlock := s.lockAll()
+	defer unlock()
+
+	ml := s.shards[shardIndex(ID)].links[ID]
+	if ml == nil || ml.UserID != userID {
+		return 0, nil
+	}
+	if ml.Deleted {
+		return 0, &RecordSoftDeletedError{ID}
+	}
+	if ml.OriginalURL == originalURL {
+		return ml.version(), nil
+	}
+	if key, o, ok := s.dedupKey(userID, originalURL); ok {
+		if _, taken := s.shards[o].originals[key]; taken {
+			return 0, &RecordDuplicateError{param: "original_url", value: originalURL}
+		}
+	}
+
+	now := time.Now().UTC()
+	if s.log != nil {
+		err := s.log.append(fileRecord{Op: fileOpUpdate, ID: ID, OriginalURL: originalURL, CreatedAt: &now})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return s.updateURL(ID, ml, originalURL, now), nil
+}
+
+// updateURL points the link ml stored under ID to originalURL and returns
+// the new version; the caller holds the locks of all shards.
+func (s *MemoryStorage) updateURL(ID string, ml *memoryLink, originalURL string, at time.Time) int {
+	if len(ml.History) == 0 {
+		ml.History = []LinkVersion{{Version: 1, OriginalURL: ml.OriginalURL, CreatedAt: ml.CreatedAt}}
+	}
+	version := ml.version() + 1
+	ml.History = append(ml.History, LinkVersion{Version: version, OriginalURL: originalURL, CreatedAt: at})
+
+	key, o, _ := s.dedupKey(ml.UserID, ml.OriginalURL)
+	if s.shards[o].originals[key] == ID {
+		delete(s.shards[o].originals, key)
+	}
+	if key, o, ok := s.dedupKey(ml.UserID, originalURL); ok {
+		if _, taken := s.shards[o].originals[key]; !taken {
+			s.shards[o].originals[key] = ID
+		}
+	}
+	ml.OriginalURL = originalURL
+
+	return version
+}
+
+func (s *MemoryStorage) GetURLHistory(ctx context.Context, ID string) ([]LinkVersion, error) {
+	if s.isClosed() {
+		return nil, ErrStorageClosed
+	}
+
+	sh := &s.shards[shardIndex(ID)]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	ml := sh.links[ID]
+	if ml == nil {
+		return nil, nil
+	}
+	if len(ml.History) == 0 {
+		return []LinkVersion{{Version: 1, OriginalURL: ml.OriginalURL, CreatedAt: ml.CreatedAt}}, nil
+	}
+
+	res := make([]LinkVersion, len(ml.History))
+	copy(res, ml.History)
+	return res, nil
+}
+
+// initMemoryStorage creates a MemoryStorage. With a non-empty path the links
+// are loaded from and persisted to the file storage at path.
+func initMemoryStorage(c app.Config, path string) (*MemoryStorage, error) {
+	if path != "" {
+		return initFileStorage(c, path)
+	}
+
+	memSt := NewMemoryStorage()
+	memSt.DedupScope = c.DedupScope
+	return memSt, nil
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMemoryStorageConcurrentAccess hammers a single MemoryStorage from many
+// goroutines. Run it with `go test -race` to have data races reported.
+func TestMemoryStorageConcurrentAccess(t *testing.T) {
+	const (
+		workers = 32
+		perUser = 200
+	)
+
+	s := NewMemoryStorage()
+	s.DedupScope = DedupGlobal
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	duplicates := 0
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			userID := fmt.Sprintf("user-%d", w)
+			for i := 0; i < perUser; i++ {
+				// Every URL is shortened by two workers, so half of the
+				// inserts must be rejected as duplicates.
+				URL := fmt.Sprintf("https://example.org/%d/%d", w/2, i)
+				err := s.AddURL(ctx, ShortLink{ID: fmt.Sprintf("%d-%d", w, i), OriginalURL: URL, UserID: userID})
+				if err != nil {
+					var rde *RecordDuplicateError
+					assert.True(t, errors.As(err, &rde))
+					mu.Lock()
+					duplicates++
+					mu.Unlock()
+				}
+
+				ID, err := s.GetURLByOriginalURL(ctx, URL, userID)
+				assert.NoError(t, err)
+				stored, err := s.GetURLByID(ctx, ID)
+				assert.NoError(t, err)
+				assert.Equal(t, URL, stored)
+
+				_, err = s.GetUserURLs(ctx, userID)
+				assert.NoError(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Equal(t, workers*perUser/2, duplicates)
+
+	total := 0
+	for w := 0; w < workers; w++ {
+		links, err := s.GetUserURLs(ctx, fmt.Sprintf("user-%d", w))
+		assert.NoError(t, err)
+		total += len(links)
+	}
+	assert.Equal(t, workers*perUser/2, total)
+}
+
+func TestMemoryStorageReloadKeepsIndex(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.csv")
+
+	s, err := initMemoryStorage(fileTestConfig(), path)
+	assert.NoError(t, err)
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u"}))
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "b", OriginalURL: "https://example.org/b", UserID: "u"}))
+	s.CleanUp(ctx, fileTestConfig())
+
+	reloaded, err := initMemoryStorage(fileTestConfig(), path)
+	assert.NoError(t, err)
+
+	ID, err := reloaded.GetURLByOriginalURL(ctx, "https://example.org/b", "u")
+	assert.NoError(t, err)
+	assert.Equal(t, "b", ID)
+
+	err = reloaded.AddURL(ctx, ShortLink{ID: "c", OriginalURL: "https://example.org/a", UserID: "u"})
+	var rde *RecordDuplicateError
+	assert.True(t, errors.As(err, &rde))
+}
+
+// BenchmarkMemoryStorageAddURL measures inserts into storages of growing
+// size; ns/op should stay flat as the number of stored links grows.
+func BenchmarkMemoryStorageAddURL(b *testing.B) {
+	for _, size := range []int{1000, 100000, 1000000} {
+		b.Run(fmt.Sprintf("links=%d", size), func(b *testing.B) {
+			ctx := context.Background()
+			s := NewMemoryStorage()
+			for i := 0; i < size; i++ {
+				_ = s.AddURL(ctx, ShortLink{ID: fmt.Sprintf("p%d", i), OriginalURL: fmt.Sprintf("https://example.org/p%d", i), UserID: "prefill"})
+			}
+
+			links := make([]ShortLink, b.N)
+			for i := range links {
+				links[i] = ShortLink{ID: fmt.Sprintf("n%d", i), OriginalURL: fmt.Sprintf("https://example.org/n%d", i), UserID: "bench"}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = s.AddURL(ctx, links[i])
+			}
+		})
+	}
+}
+
+func BenchmarkMemoryStorageGetURLByOriginalURL(b *testing.B) {
+	const size = 1000000
+
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	for i := 0; i < size; i++ {
+		_ = s.AddURL(ctx, ShortLink{ID: fmt.Sprintf("p%d", i), OriginalURL: fmt.Sprintf("https://example.org/p%d", i), UserID: "prefill"})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = s.GetURLByOriginalURL(ctx, fmt.Sprintf("https://example.org/p%d", i%size), "prefill")
+	}
+}
+
+func TestMemoryStorageSoftDelete(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"}))
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "b", OriginalURL: "https://example.org/b", UserID: "u1"}))
+	assert.NoError(t, s.AddURL(ctx, ShortLink{ID: "c", OriginalURL: "https://example.org/c", UserID: "u2"}))
+
+	IDs, err := s.DeleteUserURLs(ctx, []string{"a", "c", "missing", "a"}, "u1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, IDs)
+
+	_, err = s.GetURLByID(ctx, "a")
+	var rde *RecordSoftDeletedError
+	assert.True(t, errors.As(err, &rde))
+
+	for _, ID := range []string{"b", "c"} {
+		_, err = s.GetURLByID(ctx, ID)
+		assert.NoError(t, err)
+	}
+
+	// The original URL stays taken, as with the unique index of DBStorage.
+	err = s.AddURL(ctx, ShortLink{ID: "d", OriginalURL: "https://example.org/a", UserID: "u1"})
+	var dup *RecordDuplicateError
+	assert.True(t, errors.As(err, &dup))
+}
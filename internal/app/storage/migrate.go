@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migrationLockKey identifies the Postgres advisory lock held while
+// migrating, so that concurrently starting instances run migrations one
+// after another.
+const migrationLockKey int64 = 0x73686f7274656e
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+type migrationDriver interface {
+	Lock(ctx context.Context) error
+	Unlock(ctx context.Context) error
+	Version(ctx context.Context) (int, error)
+	Apply(ctx context.Context, m migration, up bool) error
+}
+
+// loadMigrations reads NNNN_name.up.sql / NNNN_name.down.sql pairs from dir
+// and returns them ordered by version.
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		var up bool
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			up = true
+		case strings.HasSuffix(name, ".down.sql"):
+			up = false
+		default:
+			continue
+		}
+
+		sep := strings.IndexByte(name, '_')
+		if sep < 1 {
+			return nil, fmt.Errorf("migration %s has no version prefix", name)
+		}
+		version, err := strconv.Atoi(name[:sep])
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s has invalid version prefix", name)
+		}
+
+		body, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: strings.TrimSuffix(strings.TrimSuffix(name, ".up.sql"), ".down.sql")}
+			byVersion[version] = m
+		}
+		if up {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	res := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %s has no up script", m.name)
+		}
+		res = append(res, *m)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].version < res[j].version })
+
+	return res, nil
+}
+
+// migrationTarget resolves a -migrate value ("up", "down" or a version
+// number) into the schema version to migrate to.
+func migrationTarget(spec string, current int, ms []migration) (int, error) {
+	switch spec {
+	case "up":
+		if len(ms) == 0 {
+			return 0, nil
+		}
+		return ms[len(ms)-1].version, nil
+	case "down":
+		target := 0
+		for _, m := range ms {
+			if m.version < current {
+				target = m.version
+			}
+		}
+		return target, nil
+	}
+
+	target, err := strconv.Atoi(spec)
+	if err != nil || target < 0 {
+		return 0, fmt.Errorf("invalid migration target %q", spec)
+	}
+	if target == 0 {
+		return 0, nil
+	}
+	for _, m := range ms {
+		if m.version == target {
+			return target, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown migration version %d", target)
+}
+
+// latestMigration returns the version of the last migration in dir.
+func latestMigration(dir string) (int, error) {
+	ms, err := loadMigrations(migrationFiles, dir)
+	if err != nil || len(ms) == 0 {
+		return 0, err
+	}
+
+	return ms[len(ms)-1].version, nil
+}
+
+func runMigrations(ctx context.Context, d migrationDriver, ms []migration, spec string) (int, error) {
+	err := d.Lock(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer d.Unlock(ctx)
+
+	current, err := d.Version(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	target, err := migrationTarget(spec, current, ms)
+	if err != nil {
+		return current, err
+	}
+
+	if target >= current {
+		for _, m := range ms {
+			if m.version <= current || m.version > target {
+				continue
+			}
+			err = d.Apply(ctx, m, true)
+			if err != nil {
+				return current, fmt.Errorf("migration %s: %w", m.name, err)
+			}
+			current = m.version
+		}
+		return current, nil
+	}
+
+	for i := len(ms) - 1; i >= 0; i-- {
+		m := ms[i]
+		if m.version > current || m.version <= target {
+			continue
+		}
+		if m.down == "" {
+			return current, fmt.Errorf("migration %s can't be rolled back", m.name)
+		}
+		err = d.Apply(ctx, m, false)
+		if err != nil {
+			return current, fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		current = 0
+		if i > 0 {
+			current = ms[i-1].version
+		}
+	}
+
+	return current, nil
+}
+
+type pgMigrator struct {
+	pool *pgxpool.Pool
+	conn *pgxpool.Conn
+}
+
+func (m *pgMigrator) Lock(ctx context.Context) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Advisory locks belong to the session, so the same connection is kept
+	// for the whole run and released in Unlock.
+	_, err = conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey)
+	if err != nil {
+		conn.Release()
+		return err
+	}
+	m.conn = conn
+
+	return nil
+}
+
+func (m *pgMigrator) Unlock(ctx context.Context) error {
+	defer m.conn.Release()
+	_, err := m.conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey)
+	return err
+}
+
+func (m *pgMigrator) Version(ctx context.Context) (int, error) {
+	_, err := m.conn.Exec(ctx, "CREATE TABLE IF NOT EXISTS schema_version (version integer PRIMARY KEY, applied_at timestamptz NOT NULL DEFAULT now());")
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = m.conn.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func (m *pgMigrator) Apply(ctx context.Context, mg migration, up bool) error {
+	tx, err := m.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if up {
+		_, err = tx.Exec(ctx, mg.up)
+		if err == nil {
+			_, err = tx.Exec(ctx, "INSERT INTO schema_version (version) VALUES ($1)", mg.version)
+		}
+	} else {
+		_, err = tx.Exec(ctx, mg.down)
+		if err == nil {
+			_, err = tx.Exec(ctx, "DELETE FROM schema_version WHERE version = $1", mg.version)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Migrate brings the schema to the version described by spec: "up" for the
+// latest version, "down" to roll back the last applied migration, or an
+// explicit version number. It returns the resulting schema version.
+func (s DBStorage) Migrate(ctx context.Context, spec string) (int, error) {
+	ms, err := loadMigrations(migrationFiles, "migrations/postgres")
+	if err != nil {
+		return 0, err
+	}
+
+	return runMigrations(ctx, &pgMigrator{pool: s.Pool}, ms, spec)
+}
+
+// RunMigrations connects to c.DatabaseDSN, migrates the schema according to
+// c.Migrate and disconnects.
+func RunMigrations(ctx context.Context, c app.Config) (int, error) {
+	if isSQLiteDSN(c.DatabaseDSN) {
+		sqlSt, err := NewSQLiteStorage(ctx, c)
+		if err != nil {
+			return 0, err
+		}
+		defer sqlSt.DB.Close()
+
+		return sqlSt.Migrate(ctx, c.Migrate)
+	}
+
+	dbSt, err := NewDBStorage(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	defer dbSt.Pool.Close()
+
+	return dbSt.Migrate(ctx, c.Migrate)
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeMigrator struct {
+	version int
+	applied []int
+	locked  bool
+}
+
+func (m *fakeMigrator) Lock(ctx context.Context) error {
+	m.locked = true
+	return nil
+}
+
+func (m *fakeMigrator) Unlock(ctx context.Context) error {
+	m.locked = false
+	return nil
+}
+
+func (m *fakeMigrator) Version(ctx context.Context) (int, error) {
+	return m.version, nil
+}
+
+func (m *fakeMigrator) Apply(ctx context.Context, mg migration, up bool) error {
+	if up {
+		m.applied = append(m.applied, mg.version)
+	} else {
+		m.applied = append(m.applied, -mg.version)
+	}
+	return nil
+}
+
+func TestLoadMigrations(t *testing.T) {
+	ms, err := loadMigrations(migrationFiles, "migrations/postgres")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, ms)
+
+	for i, m := range ms {
+		assert.Equal(t, i+1, m.version)
+		assert.NotEmpty(t, m.up)
+		assert.NotEmpty(t, m.down)
+	}
+}
+
+func TestRunMigrations(t *testing.T) {
+	ms := []migration{
+		{version: 1, name: "0001_a", up: "a", down: "a"},
+		{version: 2, name: "0002_b", up: "b", down: "b"},
+		{version: 3, name: "0003_c", up: "c", down: "c"},
+	}
+
+	tests := []struct {
+		name    string
+		current int
+		spec    string
+		want    int
+		applied []int
+	}{
+		{name: "up from scratch", current: 0, spec: "up", want: 3, applied: []int{1, 2, 3}},
+		{name: "up from middle", current: 2, spec: "up", want: 3, applied: []int{3}},
+		{name: "up when latest", current: 3, spec: "up", want: 3},
+		{name: "down one step", current: 3, spec: "down", want: 2, applied: []int{-3}},
+		{name: "to version", current: 3, spec: "1", want: 1, applied: []int{-3, -2}},
+		{name: "to zero", current: 2, spec: "0", want: 0, applied: []int{-2, -1}},
+	}
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			d := &fakeMigrator{version: testCase.current}
+			version, err := runMigrations(context.Background(), d, ms, testCase.spec)
+
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.want, version)
+			assert.Equal(t, testCase.applied, d.applied)
+			assert.False(t, d.locked)
+		})
+	}
+
+	_, err := runMigrations(context.Background(), &fakeMigrator{}, ms, "7")
+	assert.Error(t, err)
+}
+
+// newPostgresTestSchema returns a storage on an empty schema of its own in
+// the database at TEST_DATABASE_DSN, so that migrations can be run from
+// scratch. The schema is dropped when the test ends.
+func newPostgresTestSchema(t *testing.T) DBStorage {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	ctx := context.Background()
+
+	admin, err := pgxpool.Connect(ctx, dsn)
+	require.NoError(t, err)
+	t.Cleanup(admin.Close)
+	schema := fmt.Sprintf("migrate_test_%d", time.Now().UnixNano())
+	_, err = admin.Exec(ctx, "CREATE SCHEMA "+schema)
+	require.NoError(t, err)
+	t.Cleanup(func() { admin.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE") })
+
+	pc, err := pgxpool.ParseConfig(dsn)
+	require.NoError(t, err)
+	pc.ConnConfig.RuntimeParams["search_path"] = schema
+	pool, err := pgxpool.ConnectConfig(ctx, pc)
+	require.NoError(t, err)
+	t.Cleanup(pool.Close)
+
+	return DBStorage{Pool: pool}
+}
+
+// TestPostgresMigrationRekeysDuplicateIDs starts from the baseline schema
+// with links sharing an ID, as the batch handler used to store them, and
+// migrates it up.
+func TestPostgresMigrationRekeysDuplicateIDs(t *testing.T) {
+	s := newPostgresTestSchema(t)
+	pool := s.Pool
+	ctx := context.Background()
+
+	version, err := s.Migrate(ctx, "2")
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+	_, err = pool.Exec(ctx, `INSERT INTO shorten_urls (id, original_url, user_id) VALUES
+		('1', 'https://a.example', 'user-a'),
+		('1', 'https://b.example', 'user-b'),
+		('1', 'https://c.example', 'user-c'),
+		('2', 'https://d.example', 'user-a')`)
+	require.NoError(t, err)
+
+	version, err = s.Migrate(ctx, "up")
+	require.NoError(t, err)
+	latest, err := latestMigration("migrations/postgres")
+	require.NoError(t, err)
+	assert.Equal(t, latest, version)
+
+	rows, err := pool.Query(ctx, "SELECT id, original_url, user_id FROM shorten_urls ORDER BY original_url")
+	require.NoError(t, err)
+	defer rows.Close()
+	var IDs, URLs, users []string
+	for rows.Next() {
+		var ID, URL, userID string
+		require.NoError(t, rows.Scan(&ID, &URL, &userID))
+		IDs = append(IDs, ID)
+		URLs = append(URLs, URL)
+		users = append(users, userID)
+	}
+	require.NoError(t, rows.Err())
+
+	assert.Equal(t, []string{"https://a.example", "https://b.example", "https://c.example", "https://d.example"}, URLs)
+	assert.Equal(t, []string{"user-a", "user-b", "user-c", "user-a"}, users)
+	assert.Equal(t, "1", IDs[0])
+	assert.Equal(t, "2", IDs[3])
+	assert.NotContains(t, []string{"1", "2", IDs[2]}, IDs[1])
+	assert.NotContains(t, []string{"1", "2"}, IDs[2])
+}
+
+func TestPostgresRollbackOfDedupKeysNeedsUniqueURLs(t *testing.T) {
+	s := newPostgresTestSchema(t)
+	ctx := context.Background()
+
+	version, err := s.Migrate(ctx, "up")
+	require.NoError(t, err)
+	_, err = s.Pool.Exec(ctx, `INSERT INTO shorten_urls (id, original_url, user_id) VALUES
+		('a', 'https://example.org/a', 'u1'),
+		('b', 'https://example.org/a', 'u2')`)
+	require.NoError(t, err)
+
+	_, err = s.Migrate(ctx, "7")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "several links share an original_url")
+	current, _, err := s.SchemaVersion(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, version, current)
+
+	_, err = s.Pool.Exec(ctx, "DELETE FROM shorten_urls WHERE id = 'b'")
+	require.NoError(t, err)
+	version, err = s.Migrate(ctx, "7")
+	assert.NoError(t, err)
+	assert.Equal(t, 7, version)
+}
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS shorten_urls (
+    id varchar(36),
+    original_url varchar(255),
+    user_id varchar(36),
+    is_deleted boolean DEFAULT false
+);
+CREATE UNIQUE INDEX IF NOT EXISTS original_url_idx ON shorten_urls (original_url);
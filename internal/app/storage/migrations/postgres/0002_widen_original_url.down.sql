@@ -0,0 +1 @@
+ALTER TABLE shorten_urls ALTER COLUMN original_url TYPE varchar(255);
@@ -0,0 +1 @@
+ALTER TABLE shorten_urls DROP CONSTRAINT shorten_urls_pkey;
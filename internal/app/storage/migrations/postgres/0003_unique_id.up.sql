@@ -0,0 +1,9 @@
+-- The batch handler used to store correlation_ids as short IDs, so older
+-- databases may hold several links with the same ID. The link stored first
+-- keeps the ID; the others get a new one derived from the old ID and the row
+-- position, so that the primary key can be added without losing links.
+UPDATE shorten_urls a
+SET id = md5(a.id || ':' || a.ctid::text)
+FROM shorten_urls b
+WHERE a.id = b.id AND a.ctid > b.ctid;
+ALTER TABLE shorten_urls ADD CONSTRAINT shorten_urls_pkey PRIMARY KEY (id);
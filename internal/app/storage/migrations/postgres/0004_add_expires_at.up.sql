@@ -0,0 +1,2 @@
+ALTER TABLE shorten_urls ADD COLUMN IF NOT EXISTS expires_at timestamptz;
+CREATE INDEX IF NOT EXISTS expires_at_idx ON shorten_urls (expires_at) WHERE expires_at IS NOT NULL;
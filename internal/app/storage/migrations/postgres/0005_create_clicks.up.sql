@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS clicks (
+    id bigserial PRIMARY KEY,
+    link_id varchar(36) NOT NULL REFERENCES shorten_urls (id) ON DELETE CASCADE,
+    clicked_at timestamptz NOT NULL,
+    referrer text NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT '',
+    ip_hash text NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS clicks_link_id_clicked_at_idx ON clicks (link_id, clicked_at);
@@ -0,0 +1,3 @@
+ALTER TABLE shorten_urls ADD COLUMN IF NOT EXISTS deleted_at timestamptz;
+UPDATE shorten_urls SET deleted_at = now() WHERE is_deleted AND deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS deleted_at_idx ON shorten_urls (deleted_at) WHERE is_deleted;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS link_history (
+    link_id varchar(36) NOT NULL REFERENCES shorten_urls (id) ON DELETE CASCADE,
+    version integer NOT NULL,
+    original_url text NOT NULL,
+    created_at timestamptz,
+    PRIMARY KEY (link_id, version)
+);
@@ -0,0 +1,13 @@
+-- Under the per-user and none dedup scopes several links may share an
+-- original URL, which the unique index of the previous schema forbids. The
+-- rollback refuses to pick the links to drop: it fails until they are
+-- removed or switched to one URL each.
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM shorten_urls GROUP BY original_url HAVING count(*) > 1) THEN
+        RAISE EXCEPTION 'can''t roll back dedup keys: several links share an original_url, remove them first';
+    END IF;
+END $$;
+DROP INDEX IF EXISTS dedup_key_idx;
+ALTER TABLE shorten_urls DROP COLUMN IF EXISTS dedup_key;
+CREATE UNIQUE INDEX IF NOT EXISTS original_url_idx ON shorten_urls (original_url);
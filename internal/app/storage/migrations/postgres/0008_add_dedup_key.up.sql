@@ -0,0 +1,4 @@
+ALTER TABLE shorten_urls ADD COLUMN IF NOT EXISTS dedup_key text;
+UPDATE shorten_urls SET dedup_key = original_url WHERE dedup_key IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS dedup_key_idx ON shorten_urls (dedup_key);
+DROP INDEX IF EXISTS original_url_idx;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS shorten_urls (
+    id TEXT PRIMARY KEY,
+    original_url TEXT NOT NULL,
+    user_id TEXT,
+    is_deleted BOOLEAN NOT NULL DEFAULT 0
+);
+CREATE UNIQUE INDEX IF NOT EXISTS original_url_idx ON shorten_urls (original_url);
+CREATE INDEX IF NOT EXISTS user_id_idx ON shorten_urls (user_id);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS expires_at_idx;
+ALTER TABLE shorten_urls DROP COLUMN expires_at;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS deleted_at_idx;
+ALTER TABLE shorten_urls DROP COLUMN deleted_at;
@@ -0,0 +1,3 @@
+ALTER TABLE shorten_urls ADD COLUMN deleted_at TIMESTAMP;
+UPDATE shorten_urls SET deleted_at = CURRENT_TIMESTAMP WHERE is_deleted AND deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS deleted_at_idx ON shorten_urls (deleted_at) WHERE is_deleted;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS link_history (
+    link_id TEXT NOT NULL REFERENCES shorten_urls (id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    original_url TEXT NOT NULL,
+    created_at TIMESTAMP,
+    PRIMARY KEY (link_id, version)
+);
@@ -0,0 +1,16 @@
+-- Under the per-user and none dedup scopes several links may share an
+-- original URL, which the unique index of the previous schema forbids. The
+-- rollback refuses to pick the links to drop: it fails until they are
+-- removed or switched to one URL each. SQLite raises errors in triggers
+-- only, hence the temporary one.
+CREATE TEMP TABLE dedup_rollback_check (n INTEGER);
+CREATE TEMP TRIGGER dedup_rollback_check BEFORE INSERT ON dedup_rollback_check
+WHEN EXISTS (SELECT 1 FROM shorten_urls GROUP BY original_url HAVING count(*) > 1)
+BEGIN
+    SELECT RAISE(ABORT, 'can''t roll back dedup keys: several links share an original_url, remove them first');
+END;
+INSERT INTO dedup_rollback_check VALUES (1);
+DROP TABLE dedup_rollback_check;
+DROP INDEX IF EXISTS dedup_key_idx;
+ALTER TABLE shorten_urls DROP COLUMN dedup_key;
+CREATE UNIQUE INDEX IF NOT EXISTS original_url_idx ON shorten_urls (original_url);
@@ -0,0 +1,756 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app"
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteScheme is the DATABASE_DSN prefix selecting the SQLite storage, e.g.
+// sqlite:///var/lib/shortener/links.db.
+const sqliteScheme = "sqlite://"
+
+// sqliteMaxVars bounds the number of IDs bound to a single statement, well
+// below SQLite's limit on host parameters.
+const sqliteMaxVars = 500
+
+type SQLiteStorage struct {
+	DB           *sql.DB
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// DedupScope is one of the Dedup scopes.
+	DedupScope string
+}
+
+func isSQLiteDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, sqliteScheme)
+}
+
+// sqliteDataSource turns a sqlite:// DSN into a go-sqlite3 data source name.
+// Writers wait for each other instead of failing with SQLITE_BUSY, and the
+// WAL journal lets reads go on while a write is in progress.
+func sqliteDataSource(dsn string) (string, error) {
+	p := strings.TrimPrefix(dsn, sqliteScheme)
+	if p == "" {
+		return "", fmt.Errorf("sqlite DSN %q has no database path", dsn)
+	}
+
+	params := "_busy_timeout=5000&_foreign_keys=on"
+	if p != ":memory:" {
+		params += "&_journal_mode=WAL&_synchronous=NORMAL"
+	}
+	sep := "?"
+	if strings.Contains(p, "?") {
+		sep = "&"
+	}
+
+	return "file:" + p + sep + params, nil
+}
+
+func NewSQLiteStorage(ctx context.Context, c app.Config) (*SQLiteStorage, error) {
+	source, err := sqliteDataSource(c.DatabaseDSN)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", source)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(source, ":memory:") {
+		// Every connection to :memory: opens a database of its own.
+		db.SetMaxOpenConns(1)
+	} else if c.DatabaseMaxConns > 0 {
+		db.SetMaxOpenConns(int(c.DatabaseMaxConns))
+	}
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStorage{
+		DB:           db,
+		ReadTimeout:  c.StorageReadTimeout,
+		WriteTimeout: c.StorageWriteTimeout,
+		DedupScope:   c.DedupScope,
+	}, nil
+}
+
+// sqliteInsertError translates a failed insert of link into a
+// RecordIDCollisionError or RecordDuplicateError when it broke one of the
+// unique constraints.
+func sqliteInsertError(op string, link ShortLink, err error) error {
+	var sqlErr sqlite3.Error
+	if errors.As(err, &sqlErr) {
+		switch sqlErr.ExtendedCode {
+		case sqlite3.ErrConstraintPrimaryKey:
+			return &RecordIDCollisionError{link.ID}
+		case sqlite3.ErrConstraintUnique:
+			return &RecordDuplicateError{param: "original_url", value: link.OriginalURL}
+		}
+	}
+	return wrapTimeout(op, err)
+}
+
+func (s SQLiteStorage) GetURLByID(ctx context.Context, ID string) (string, error) {
+	var res struct {
+		originalURL string
+		isDeleted   bool
+		expiresAt   *time.Time
+	}
+
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, "SELECT original_url, is_deleted, expires_at FROM shorten_urls WHERE id = ?", ID).Scan(&res.originalURL, &res.isDeleted, &res.expiresAt)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", wrapTimeout("GetURLByID", err)
+	}
+
+	if res.isDeleted {
+		return "", &RecordSoftDeletedError{ID}
+	}
+	if res.expiresAt != nil && isExpired(*res.expiresAt, time.Now()) {
+		return "", &RecordExpiredError{ID}
+	}
+
+	return res.originalURL, nil
+}
+
+func (s SQLiteStorage) GetLinkByID(ctx context.Context, ID string) (ShortLink, error) {
+	res := ShortLink{ID: ID}
+	var expiresAt *time.Time
+
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, "SELECT original_url, COALESCE(user_id, ''), expires_at FROM shorten_urls WHERE id = ?", ID).Scan(&res.OriginalURL, &res.UserID, &expiresAt)
+	if err == sql.ErrNoRows {
+		return ShortLink{}, nil
+	}
+	if err != nil {
+		return ShortLink{}, wrapTimeout("GetLinkByID", err)
+	}
+	res.ExpiresAt = fromNullTime(expiresAt)
+
+	return res, nil
+}
+
+func (s SQLiteStorage) GetURLByOriginalURL(ctx context.Context, OriginalURL string, userID string) (string, error) {
+	var res string
+
+	key := nullDedupKey(s.DedupScope, userID, OriginalURL)
+	if key == nil {
+		return "", nil
+	}
+
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, "SELECT id FROM shorten_urls WHERE dedup_key = ?", key).Scan(&res)
+	if err == sql.ErrNoRows {
+		return res, nil
+	}
+	if err != nil {
+		return "", wrapTimeout("GetURLByOriginalURL", err)
+	}
+
+	return res, nil
+}
+
+func (s SQLiteStorage) GetUserURLs(ctx context.Context, userID string) ([]ShortLink, error) {
+	res := make([]ShortLink, 0)
+
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, "SELECT id, original_url, expires_at FROM shorten_urls WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, wrapTimeout("GetUserURLs", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := ShortLink{UserID: userID}
+		var expiresAt *time.Time
+		err := rows.Scan(&r.ID, &r.OriginalURL, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		r.ExpiresAt = fromNullTime(expiresAt)
+		res = append(res, r)
+	}
+
+	return res, wrapTimeout("GetUserURLs", rows.Err())
+}
+
+// sqlitePurgeExpiredDuplicate removes an expired link holding a dedup key,
+// so that a new link can take the key over.
+const sqlitePurgeExpiredDuplicate = "DELETE FROM shorten_urls WHERE dedup_key = ? AND expires_at <= ?"
+
+// sqliteInsert inserts a link; with sqliteInsertIgnore appended it skips a
+// link duplicating a stored one.
+const (
+	sqliteInsert       = "INSERT INTO shorten_urls (id, original_url, user_id, expires_at, dedup_key) VALUES (?, ?, ?, ?, ?)"
+	sqliteInsertIgnore = " ON CONFLICT (dedup_key) DO NOTHING"
+)
+
+// AddURL stores link. An expired link it duplicates is purged to make room
+// for it.
+func (s SQLiteStorage) AddURL(ctx context.Context, link ShortLink) error {
+	ctx, cancel := withTimeout(ctx, s.WriteTimeout)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapTimeout("AddURL", err)
+	}
+	defer tx.Rollback()
+
+	key := nullDedupKey(s.DedupScope, link.UserID, link.OriginalURL)
+	_, err = tx.ExecContext(ctx, sqlitePurgeExpiredDuplicate, key, time.Now().UTC())
+	if err != nil {
+		return wrapTimeout("AddURL", err)
+	}
+	_, err = tx.ExecContext(ctx, sqliteInsert, link.ID, link.OriginalURL, link.UserID, toNullTime(link.ExpiresAt), key)
+	if err != nil {
+		return sqliteInsertError("AddURL", link, err)
+	}
+
+	return wrapTimeout("AddURL", tx.Commit())
+}
+
+// AddURLBatch inserts links in a single transaction.
+func (s SQLiteStorage) AddURLBatch(ctx context.Context, links []ShortLink) ([]BatchResult, error) {
+	ctx, cancel := withTimeout(ctx, s.WriteTimeout)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, wrapTimeout("AddURLBatch", err)
+	}
+	defer tx.Rollback()
+
+	purge, err := tx.PrepareContext(ctx, sqlitePurgeExpiredDuplicate)
+	if err != nil {
+		return nil, wrapTimeout("AddURLBatch", err)
+	}
+	defer purge.Close()
+
+	stmt, err := tx.PrepareContext(ctx, sqliteInsert+sqliteInsertIgnore)
+	if err != nil {
+		return nil, wrapTimeout("AddURLBatch", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now().UTC()
+	res := make([]BatchResult, len(links))
+	for n, link := range links {
+		key := nullDedupKey(s.DedupScope, link.UserID, link.OriginalURL)
+		_, err = purge.ExecContext(ctx, key, now)
+		if err != nil {
+			return nil, wrapTimeout("AddURLBatch", err)
+		}
+		r, err := stmt.ExecContext(ctx, link.ID, link.OriginalURL, link.UserID, toNullTime(link.ExpiresAt), key)
+		if err != nil {
+			return nil, sqliteInsertError("AddURLBatch", link, err)
+		}
+		inserted, err := r.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if inserted > 0 {
+			res[n] = BatchResult{ID: link.ID, Status: BatchCreated}
+			continue
+		}
+
+		err = tx.QueryRowContext(ctx, "SELECT id FROM shorten_urls WHERE dedup_key = ?", key).Scan(&res[n].ID)
+		if err != nil {
+			return nil, wrapTimeout("AddURLBatch", err)
+		}
+		res[n].Status = BatchExisting
+	}
+
+	return res, wrapTimeout("AddURLBatch", tx.Commit())
+}
+
+func (s SQLiteStorage) PurgeExpired(ctx context.Context, before time.Time) (int64, error) {
+	ctx, cancel := withTimeout(ctx, s.WriteTimeout)
+	defer cancel()
+
+	r, err := s.DB.ExecContext(ctx, "DELETE FROM shorten_urls WHERE expires_at <= ?", before.UTC())
+	if err != nil {
+		return 0, wrapTimeout("PurgeExpired", err)
+	}
+
+	return r.RowsAffected()
+}
+
+// AddClicks inserts clicks in one transaction, skipping the clicks on links
+// which were removed in the meantime.
+func (s SQLiteStorage) AddClicks(ctx context.Context, clicks []Click) error {
+	ctx, cancel := withTimeout(ctx, s.WriteTimeout)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapTimeout("AddClicks", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO clicks (link_id, clicked_at, referrer, user_agent, ip_hash)
+SELECT id, ?, ?, ?, ? FROM shorten_urls WHERE id = ?`)
+	if err != nil {
+		return wrapTimeout("AddClicks", err)
+	}
+	defer stmt.Close()
+
+	for _, click := range clicks {
+		_, err = stmt.ExecContext(ctx, click.At.UTC(), click.Referrer, click.UserAgent, click.IPHash, click.LinkID)
+		if err != nil {
+			return wrapTimeout("AddClicks", err)
+		}
+	}
+
+	return wrapTimeout("AddClicks", tx.Commit())
+}
+
+// GetClickStats groups the clicks by the date prefix of clicked_at, which
+// is stored in UTC.
+func (s SQLiteStorage) GetClickStats(ctx context.Context, ID string, since time.Time) (ClickStats, error) {
+	var res ClickStats
+
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, "SELECT count(*) FROM clicks WHERE link_id = ?", ID).Scan(&res.Total)
+	if err != nil {
+		return res, wrapTimeout("GetClickStats", err)
+	}
+
+	rows, err := s.DB.QueryContext(ctx, `SELECT substr(clicked_at, 1, 10) AS day, count(*)
+FROM clicks WHERE link_id = ? AND clicked_at >= ?
+GROUP BY day ORDER BY day`, ID, since.UTC().Truncate(24*time.Hour))
+	if err != nil {
+		return res, wrapTimeout("GetClickStats", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var day string
+		var d DailyClicks
+		err := rows.Scan(&day, &d.Clicks)
+		if err != nil {
+			return res, err
+		}
+		d.Day, err = time.Parse(clickDayLayout, day)
+		if err != nil {
+			return res, err
+		}
+		res.Daily = append(res.Daily, d)
+	}
+
+	return res, wrapTimeout("GetClickStats", rows.Err())
+}
+
+func (s SQLiteStorage) GetServiceStats(ctx context.Context) (ServiceStats, error) {
+	var res ServiceStats
+
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, `SELECT
+		count(*) FILTER (WHERE NOT is_deleted),
+		count(DISTINCT NULLIF(user_id, '')),
+		count(*) FILTER (WHERE is_deleted),
+		(SELECT count(*) FROM clicks)
+	FROM shorten_urls`).Scan(&res.URLs, &res.Users, &res.Deleted, &res.Clicks)
+	return res, wrapTimeout("GetServiceStats", err)
+}
+
+func (s SQLiteStorage) WalkLinkIDs(ctx context.Context, fn func(ID string)) error {
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, "SELECT id FROM shorten_urls")
+	if err != nil {
+		return wrapTimeout("WalkLinkIDs", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ID string
+		err := rows.Scan(&ID)
+		if err != nil {
+			return err
+		}
+		fn(ID)
+	}
+
+	return wrapTimeout("WalkLinkIDs", rows.Err())
+}
+
+func (s SQLiteStorage) Ping(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	return wrapTimeout("Ping", s.DB.PingContext(ctx))
+}
+
+func (s SQLiteStorage) PoolStats() PoolStats {
+	st := s.DB.Stats()
+	return PoolStats{
+		Total:    int32(st.OpenConnections),
+		Idle:     int32(st.Idle),
+		Acquired: int32(st.InUse),
+		Max:      int32(st.MaxOpenConnections),
+	}
+}
+
+func (s SQLiteStorage) SchemaVersion(ctx context.Context) (int, int, error) {
+	latest, err := latestMigration("migrations/sqlite")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	var current int
+	err = s.DB.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&current)
+	return current, latest, wrapTimeout("SchemaVersion", err)
+}
+
+func (s SQLiteStorage) CleanUp(ctx context.Context, c app.Config) {
+	s.DB.Close()
+}
+
+func (s SQLiteStorage) DeleteUserURLs(ctx context.Context, IDs []string, userID string) ([]string, error) {
+	ctx, cancel := withTimeout(ctx, s.WriteTimeout)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, wrapTimeout("DeleteUserURLs", err)
+	}
+	defer tx.Rollback()
+
+	var deleted []string
+	now := time.Now().UTC()
+	for len(IDs) > 0 {
+		n := len(IDs)
+		if n > sqliteMaxVars {
+			n = sqliteMaxVars
+		}
+
+		args := make([]interface{}, 0, n+2)
+		args = append(args, now, userID)
+		for _, ID := range IDs[:n] {
+			args = append(args, ID)
+		}
+		query := "UPDATE shorten_urls SET is_deleted = 1, deleted_at = COALESCE(deleted_at, ?) WHERE user_id = ? AND id IN (?" + strings.Repeat(", ?", n-1) + ") RETURNING id"
+
+		deleted, err = sqliteReturnedIDs(ctx, tx, deleted, query, args)
+		if err != nil {
+			return nil, wrapTimeout("DeleteUserURLs", err)
+		}
+		IDs = IDs[n:]
+	}
+
+	return deleted, wrapTimeout("DeleteUserURLs", tx.Commit())
+}
+
+// sqliteReturnedIDs runs an UPDATE … RETURNING id query and appends the
+// returned IDs to IDs.
+func sqliteReturnedIDs(ctx context.Context, tx *sql.Tx, IDs []string, query string, args []interface{}) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return IDs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ID string
+		err = rows.Scan(&ID)
+		if err != nil {
+			return IDs, err
+		}
+		IDs = append(IDs, ID)
+	}
+
+	return IDs, rows.Err()
+}
+
+func (s SQLiteStorage) RestoreUserURLs(ctx context.Context, IDs []string, userID string, deletedSince time.Time) ([]string, error) {
+	ctx, cancel := withTimeout(ctx, s.WriteTimeout)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, wrapTimeout("RestoreUserURLs", err)
+	}
+	defer tx.Rollback()
+
+	var restored []string
+	for len(IDs) > 0 {
+		n := len(IDs)
+		if n > sqliteMaxVars {
+			n = sqliteMaxVars
+		}
+
+		args := make([]interface{}, 0, n+2)
+		args = append(args, userID, deletedSince.UTC())
+		for _, ID := range IDs[:n] {
+			args = append(args, ID)
+		}
+		query := "UPDATE shorten_urls SET is_deleted = 0, deleted_at = NULL WHERE user_id = ? AND is_deleted AND deleted_at >= ? AND id IN (?" + strings.Repeat(", ?", n-1) + ") RETURNING id"
+
+		restored, err = sqliteReturnedIDs(ctx, tx, restored, query, args)
+		if err != nil {
+			return nil, wrapTimeout("RestoreUserURLs", err)
+		}
+		IDs = IDs[n:]
+	}
+
+	return restored, wrapTimeout("RestoreUserURLs", tx.Commit())
+}
+
+func (s SQLiteStorage) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	ctx, cancel := withTimeout(ctx, s.WriteTimeout)
+	defer cancel()
+
+	r, err := s.DB.ExecContext(ctx, "DELETE FROM shorten_urls WHERE is_deleted AND deleted_at < ?", before.UTC())
+	if err != nil {
+		return 0, wrapTimeout("PurgeDeleted", err)
+	}
+
+	return r.RowsAffected()
+}
+
+// UpdateURL starts with a write, seeding the history of a link never updated
+// with the URL it was created with as version 1, unless the URL stays the
+// same: like the other storages, a no-op update records nothing. The write
+// takes the database's write lock even when it inserts no row, so the reads
+// which follow can't go stale before the transaction commits.
+func (s SQLiteStorage) UpdateURL(ctx context.Context, ID string, userID string, originalURL string) (int, error) {
+	ctx, cancel := withTimeout(ctx, s.WriteTimeout)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, wrapTimeout("UpdateURL", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO link_history (link_id, version, original_url)
+SELECT id, 1, original_url FROM shorten_urls WHERE id = ? AND user_id = ? AND NOT is_deleted AND original_url <> ?
+AND NOT EXISTS (SELECT 1 FROM link_history WHERE link_id = ?)`, ID, userID, originalURL, ID)
+	if err != nil {
+		return 0, wrapTimeout("UpdateURL", err)
+	}
+
+	var current string
+	var isDeleted bool
+	err = tx.QueryRowContext(ctx, "SELECT original_url, is_deleted FROM shorten_urls WHERE id = ? AND user_id = ?", ID, userID).Scan(&current, &isDeleted)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, wrapTimeout("UpdateURL", err)
+	}
+	if isDeleted {
+		return 0, &RecordSoftDeletedError{ID}
+	}
+
+	var version int
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 1) FROM link_history WHERE link_id = ?", ID).Scan(&version)
+	if err != nil {
+		return 0, wrapTimeout("UpdateURL", err)
+	}
+	if current != originalURL {
+		version++
+		_, err = tx.ExecContext(ctx, "UPDATE shorten_urls SET original_url = ?, dedup_key = ? WHERE id = ?", originalURL, nullDedupKey(s.DedupScope, userID, originalURL), ID)
+		if err != nil {
+			return 0, sqliteInsertError("UpdateURL", ShortLink{ID: ID, OriginalURL: originalURL}, err)
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO link_history (link_id, version, original_url, created_at) VALUES (?, ?, ?, ?)", ID, version, originalURL, time.Now().UTC())
+		if err != nil {
+			return 0, wrapTimeout("UpdateURL", err)
+		}
+	}
+
+	return version, wrapTimeout("UpdateURL", tx.Commit())
+}
+
+// GetURLHistory reads the history table. A link which was never updated has
+// no history rows, and its current URL is reported as version 1.
+func (s SQLiteStorage) GetURLHistory(ctx context.Context, ID string) ([]LinkVersion, error) {
+	ctx, cancel := withTimeout(ctx, s.ReadTimeout)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, "SELECT version, original_url, created_at FROM link_history WHERE link_id = ? ORDER BY version", ID)
+	if err != nil {
+		return nil, wrapTimeout("GetURLHistory", err)
+	}
+	defer rows.Close()
+
+	var res []LinkVersion
+	for rows.Next() {
+		var v LinkVersion
+		var createdAt *time.Time
+		err = rows.Scan(&v.Version, &v.OriginalURL, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		v.CreatedAt = fromNullTime(createdAt)
+		res = append(res, v)
+	}
+	err = rows.Err()
+	if err != nil || len(res) > 0 {
+		return res, wrapTimeout("GetURLHistory", err)
+	}
+
+	var originalURL string
+	err = s.DB.QueryRowContext(ctx, "SELECT original_url FROM shorten_urls WHERE id = ?", ID).Scan(&originalURL)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, wrapTimeout("GetURLHistory", err)
+	}
+
+	return []LinkVersion{{Version: 1, OriginalURL: originalURL}}, nil
+}
+
+// sqliteMigrator runs migrations on a single connection inside one
+// immediate transaction. It holds the database's write lock for the whole
+// run, so other processes sharing the file wait, and a failed run leaves
+// the schema untouched.
+type sqliteMigrator struct {
+	db     *sql.DB
+	conn   *sql.Conn
+	failed bool
+}
+
+func (m *sqliteMigrator) Lock(ctx context.Context) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, "BEGIN IMMEDIATE")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	m.conn = conn
+
+	return nil
+}
+
+func (m *sqliteMigrator) Unlock(ctx context.Context) error {
+	defer m.conn.Close()
+
+	end := "COMMIT"
+	if m.failed {
+		end = "ROLLBACK"
+	}
+	_, err := m.conn.ExecContext(context.Background(), end)
+	return err
+}
+
+func (m *sqliteMigrator) Version(ctx context.Context) (int, error) {
+	_, err := m.conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)")
+	if err != nil {
+		m.failed = true
+		return 0, err
+	}
+
+	var version int
+	err = m.conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	if err != nil {
+		m.failed = true
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func (m *sqliteMigrator) Apply(ctx context.Context, mg migration, up bool) error {
+	var err error
+	if up {
+		_, err = m.conn.ExecContext(ctx, mg.up)
+		if err == nil {
+			_, err = m.conn.ExecContext(ctx, "INSERT INTO schema_version (version) VALUES (?)", mg.version)
+		}
+	} else {
+		_, err = m.conn.ExecContext(ctx, mg.down)
+		if err == nil {
+			_, err = m.conn.ExecContext(ctx, "DELETE FROM schema_version WHERE version = ?", mg.version)
+		}
+	}
+	if err != nil {
+		m.failed = true
+	}
+
+	return err
+}
+
+// Migrate brings the schema to the version described by spec, see
+// DBStorage.Migrate.
+func (s SQLiteStorage) Migrate(ctx context.Context, spec string) (int, error) {
+	ms, err := loadMigrations(migrationFiles, "migrations/sqlite")
+	if err != nil {
+		return 0, err
+	}
+
+	return runMigrations(ctx, &sqliteMigrator{db: s.DB}, ms, spec)
+}
+
+// applyDedupScope rekeys the stored links when DedupScope has changed since
+// they were stored, see dedupRekeySQL.
+func (s SQLiteStorage) applyDedupScope(ctx context.Context) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range dedupRekeySQL(s.DedupScope, "IS NOT") {
+		_, err = tx.ExecContext(ctx, query)
+		if err != nil {
+			return fmt.Errorf("apply dedup scope %q: %w", s.DedupScope, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func initSQLiteStorage(c app.Config) (*SQLiteStorage, error) {
+	sqlSt, err := NewSQLiteStorage(context.Background(), c)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = sqlSt.Migrate(context.Background(), "up")
+	if err == nil {
+		err = sqlSt.applyDedupScope(context.Background())
+	}
+	if err != nil {
+		sqlSt.DB.Close()
+		return nil, err
+	}
+
+	return sqlSt, nil
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSQLiteStorage(t *testing.T) *SQLiteStorage {
+	c := app.Config{DatabaseDSN: "sqlite://" + filepath.Join(t.TempDir(), "storage.db")}
+	s, err := initSQLiteStorage(c)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.CleanUp(context.Background(), c) })
+	return s
+}
+
+func TestSQLiteStorageMigrateDownAndUp(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLiteStorage(t)
+
+	version, err := s.Migrate(ctx, "0")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, version)
+	_, err = s.GetURLByID(ctx, "a")
+	assert.Error(t, err)
+
+	version, err = s.Migrate(ctx, "up")
+	assert.NoError(t, err)
+	assert.Equal(t, 6, version)
+	_, err = s.GetURLByID(ctx, "a")
+	assert.NoError(t, err)
+}
+
+func TestSQLiteStorageSchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLiteStorage(t)
+
+	current, latest, err := s.SchemaVersion(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, latest)
+	assert.Equal(t, latest, current)
+
+	_, err = s.Migrate(ctx, "down")
+	require.NoError(t, err)
+	current, latest, err = s.SchemaVersion(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, current)
+	assert.Equal(t, 6, latest)
+}
+
+func TestSQLiteStorageRollbackOfDedupKeysNeedsUniqueURLs(t *testing.T) {
+	ctx := context.Background()
+	c := app.Config{DatabaseDSN: "sqlite://" + filepath.Join(t.TempDir(), "storage.db"), DedupScope: DedupNone}
+	s, err := initSQLiteStorage(c)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.CleanUp(ctx, c) })
+	require.NoError(t, s.AddURL(ctx, ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"}))
+	require.NoError(t, s.AddURL(ctx, ShortLink{ID: "b", OriginalURL: "https://example.org/a", UserID: "u2"}))
+
+	version, err := s.Migrate(ctx, "down")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "several links share an original_url")
+	assert.Equal(t, 6, version)
+	current, _, err := s.SchemaVersion(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, current)
+
+	_, err = s.DB.ExecContext(ctx, "DELETE FROM shorten_urls WHERE id = 'b'")
+	require.NoError(t, err)
+	version, err = s.Migrate(ctx, "down")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, version)
+}
+
+func TestSQLiteStorageRekeysOnDedupScopeChange(t *testing.T) {
+	ctx := context.Background()
+	c := app.Config{DatabaseDSN: "sqlite://" + filepath.Join(t.TempDir(), "storage.db")}
+	open := func(scope string) *SQLiteStorage {
+		c.DedupScope = scope
+		s, err := initSQLiteStorage(c)
+		require.NoError(t, err)
+		t.Cleanup(func() { s.CleanUp(ctx, c) })
+		return s
+	}
+
+	s := open(DedupNone)
+	require.NoError(t, s.AddURL(ctx, ShortLink{ID: "b", OriginalURL: "https://example.org/a", UserID: "u1"}))
+	require.NoError(t, s.AddURL(ctx, ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u2"}))
+	require.NoError(t, s.AddURL(ctx, ShortLink{ID: "c", OriginalURL: "https://example.org/a", UserID: "u2"}))
+
+	s = open(DedupPerUser)
+	ID, err := s.GetURLByOriginalURL(ctx, "https://example.org/a", "u1")
+	assert.NoError(t, err)
+	assert.Equal(t, "b", ID)
+	ID, err = s.GetURLByOriginalURL(ctx, "https://example.org/a", "u2")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", ID)
+
+	// The links left without a key still work.
+	s = open(DedupGlobal)
+	ID, err = s.GetURLByOriginalURL(ctx, "https://example.org/a", "u3")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", ID)
+	for _, ID := range []string{"a", "b", "c"} {
+		URL, err := s.GetURLByID(ctx, ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "https://example.org/a", URL)
+	}
+	err = s.AddURL(ctx, ShortLink{ID: "d", OriginalURL: "https://example.org/a", UserID: "u3"})
+	var rde *RecordDuplicateError
+	assert.ErrorAs(t, err, &rde)
+}
+
+func TestSQLiteStorageNoOpUpdateRecordsNoHistory(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLiteStorage(t)
+	require.NoError(t, s.AddURL(ctx, ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"}))
+
+	version, err := s.UpdateURL(ctx, "a", "u1", "https://example.org/a")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version)
+
+	var rows int
+	require.NoError(t, s.DB.QueryRowContext(ctx, "SELECT count(*) FROM link_history").Scan(&rows))
+	assert.Zero(t, rows)
+}
@@ -2,311 +2,468 @@ package storage
 
 import (
 	"context"
-	"encoding/csv"
 	"errors"
 	"fmt"
-	"os"
+	"log"
+	"time"
 
 	"github.com/JamesDeGreese/ya_golang/internal/app"
 	"github.com/jackc/pgconn"
-	"github.com/jackc/pgerrcode"
-	"github.com/jackc/pgx/pgtype"
-	"github.com/jackc/pgx/v4"
 )
 
 type Repository interface {
-	GetURLByID(ID string) (string, error)
-	GetURLByOriginalURL(OriginalURL string) (string, error)
-	AddURL(link ShortLink) error
-	AddURLBatch(links []ShortLink) error
-	GetUserURLs(userID string) []ShortLink
-	CleanUp(c app.Config)
-	DeleteUserURLs(IDs []string, userID string) error
-}
-
-type MemoryStorage struct {
-	ShortenURLs map[string]string
-	UserLinks   map[string][]string
-}
-
-type DBStorage struct {
-	DBConn *pgx.Conn
+	GetURLByID(ctx context.Context, ID string) (string, error)
+	// GetURLByOriginalURL returns the ID of the link which a new link of
+	// userID for OriginalURL would duplicate under the storage's dedup scope,
+	// or "" if there is none.
+	GetURLByOriginalURL(ctx context.Context, OriginalURL string, userID string) (string, error)
+	// GetLinkByID returns the link stored under ID whether it is deleted or
+	// not, or a zero ShortLink if there is none.
+	GetLinkByID(ctx context.Context, ID string) (ShortLink, error)
+	// AddURL fails with a RecordDuplicateError when link duplicates a stored
+	// one under the storage's dedup scope.
+	AddURL(ctx context.Context, link ShortLink) error
+	// AddURLBatch stores links atomically: if it fails, none of them is
+	// stored. A link duplicating a stored one, or one earlier in the batch,
+	// is reported as BatchExisting instead of failing the batch.
+	// A link whose ID is taken fails the batch with a RecordIDCollisionError.
+	AddURLBatch(ctx context.Context, links []ShortLink) ([]BatchResult, error)
+	GetUserURLs(ctx context.Context, userID string) ([]ShortLink, error)
+	CleanUp(ctx context.Context, c app.Config)
+	// Ping checks that the storage can serve requests.
+	Ping(ctx context.Context) error
+	// DeleteUserURLs marks the links of userID among IDs as deleted and
+	// returns their IDs, in no particular order, those deleted before
+	// included. IDs of other users or of no link are skipped.
+	DeleteUserURLs(ctx context.Context, IDs []string, userID string) ([]string, error)
+	// RestoreUserURLs undoes the deletion of the links of userID among IDs
+	// which were deleted at or after deletedSince and returns their IDs.
+	RestoreUserURLs(ctx context.Context, IDs []string, userID string, deletedSince time.Time) ([]string, error)
+	// PurgeDeleted removes the links deleted before before and returns how
+	// many were removed.
+	PurgeDeleted(ctx context.Context, before time.Time) (int64, error)
+	// PurgeExpired removes the links which expired at or before before and
+	// returns how many were removed.
+	PurgeExpired(ctx context.Context, before time.Time) (int64, error)
+	// AddClicks records redirects. Clicks on links which no longer exist are
+	// dropped. The SQL storages keep every click with its details; the
+	// memory and file storages keep the daily counts only, which is all
+	// GetClickStats reports, so that their size does not grow with the
+	// traffic.
+	AddClicks(ctx context.Context, clicks []Click) error
+	// GetClickStats returns the number of clicks on the link ID, in total and
+	// per UTC day starting from the day of since.
+	GetClickStats(ctx context.Context, ID string, since time.Time) (ClickStats, error)
+	// UpdateURL points the link ID of userID to originalURL and records the
+	// change in the link's history. It returns the resulting version, or 0
+	// if userID has no link ID. Setting the current URL again records
+	// nothing.
+	UpdateURL(ctx context.Context, ID string, userID string, originalURL string) (int, error)
+	// GetURLHistory returns the destinations of the link ID, oldest first,
+	// or nil if there is no link ID.
+	GetURLHistory(ctx context.Context, ID string) ([]LinkVersion, error)
+	// GetServiceStats returns the totals over the whole storage.
+	GetServiceStats(ctx context.Context) (ServiceStats, error)
 }
 
 type ShortLink struct {
 	ID          string
 	OriginalURL string
 	UserID      string
+	// ExpiresAt is the time the link stops working; zero means never.
+	ExpiresAt time.Time
 }
 
-type RecordDuplicateError struct {
-	param string
-	value string
+// LinkVersion is a destination a link has had. Version 1 is the URL the link
+// was created with; its CreatedAt is zero when the storage did not record
+// the creation time.
+type LinkVersion struct {
+	Version     int
+	OriginalURL string
+	CreatedAt   time.Time
 }
 
-func (e *RecordDuplicateError) Error() string {
-	return fmt.Sprintf("Record with same param %s with value %s already exists", e.param, e.value)
+// toNullTime maps the zero time to NULL for the SQL storages.
+func toNullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
 }
 
-type RecordSoftDeletedError struct {
-	ID string
+func fromNullTime(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return t.UTC()
 }
 
-func (e *RecordSoftDeletedError) Error() string {
-	return fmt.Sprintf("Record with ID %s was marked as deleted", e.ID)
+// Click is a redirect through a short link. IPHash is a salted hash of the
+// client address; the address itself is never stored.
+type Click struct {
+	LinkID    string
+	At        time.Time
+	Referrer  string
+	UserAgent string
+	IPHash    string
 }
 
-func (s MemoryStorage) GetURLByID(ID string) (string, error) {
-	item := s.ShortenURLs[ID]
-
-	if item == "" {
-		return "", fmt.Errorf("item not found")
-	}
+type DailyClicks struct {
+	// Day is the midnight UTC starting the day.
+	Day    time.Time
+	Clicks int64
+}
 
-	return item, nil
+// ClickStats holds the clicks on a link. Daily lists only the days with
+// clicks, in chronological order.
+type ClickStats struct {
+	Total int64
+	Daily []DailyClicks
 }
 
-func (s MemoryStorage) GetURLByOriginalURL(OriginalURL string) (string, error) {
-	rev := make(map[string]string, len(s.ShortenURLs))
-	for ID, URL := range s.ShortenURLs {
-		rev[URL] = ID
-	}
+// ServiceStats holds the totals of a storage. URLs counts the links which
+// are not deleted, expired ones included until they are purged, and Users
+// the distinct owners of any stored link.
+type ServiceStats struct {
+	URLs    int64
+	Users   int64
+	Deleted int64
+	Clicks  int64
+}
 
-	item := rev[OriginalURL]
+// Dedup scopes, selected by Config.DedupScope, tell which stored links a new
+// link for the same original URL duplicates.
+const (
+	// DedupGlobal makes any link of the URL a duplicate, whoever owns it.
+	DedupGlobal = "global"
+	// DedupPerUser makes only the links of the same user duplicates.
+	DedupPerUser = "per-user"
+	// DedupNone stores every link, duplicates included.
+	DedupNone = "none"
+)
 
-	if item == "" {
-		return "", fmt.Errorf("item not found")
+// dedupKey returns the key which is unique among the links stored under
+// scope, or false if scope deduplicates nothing. Any scope but DedupPerUser
+// and DedupNone, the empty one included, is taken as DedupGlobal. User IDs
+// hold no spaces, so a per-user key can't be mistaken for another user's.
+func dedupKey(scope, userID, originalURL string) (string, bool) {
+	switch scope {
+	case DedupPerUser:
+		return userID + " " + originalURL, true
+	case DedupNone:
+		return "", false
 	}
+	return originalURL, true
+}
 
-	return item, nil
+// nullDedupKey is the dedup key for the SQL storages, where NULL keys never
+// conflict.
+func nullDedupKey(scope, userID, originalURL string) *string {
+	key, ok := dedupKey(scope, userID, originalURL)
+	if !ok {
+		return nil
+	}
+	return &key
 }
 
-func (s MemoryStorage) GetUserURLs(userID string) []ShortLink {
-	var res []ShortLink
-	userURLs := s.UserLinks[userID]
-	if len(userURLs) == 0 {
-		return res
+// dedupKeySQL returns the SQL expression computing the dedup_key column of a
+// shorten_urls row under scope, the same way dedupKey does.
+func dedupKeySQL(scope string) string {
+	switch scope {
+	case DedupPerUser:
+		return "COALESCE(user_id, '') || ' ' || original_url"
+	case DedupNone:
+		return "NULL"
 	}
+	return "original_url"
+}
 
-	for _, shortID := range userURLs {
-		URL, _ := s.GetURLByID(shortID)
-		res = append(res, ShortLink{
-			shortID,
-			URL,
-			userID,
-		})
+// dedupRekeySQL returns the statements which bring the dedup_key column in
+// line with scope after it has changed. Keys of another scope are cleared
+// first; then, among the links sharing a key, the one with the least ID
+// takes it, unless a link holds it already. The other links keep no key:
+// they stay reachable but are not deduplicated against, much like the
+// links stored before a scope was enforced. distinct is the SQL operator
+// telling two nullable values apart.
+func dedupRekeySQL(scope string, distinct string) []string {
+	expr := dedupKeySQL(scope)
+	return []string{
+		fmt.Sprintf("UPDATE shorten_urls SET dedup_key = NULL WHERE dedup_key IS NOT NULL AND dedup_key %s (%s)", distinct, expr),
+		fmt.Sprintf(`UPDATE shorten_urls SET dedup_key = (%[1]s) WHERE id IN (
+	SELECT MIN(id) FROM shorten_urls WHERE (%[1]s) IS NOT NULL GROUP BY (%[1]s) HAVING COUNT(dedup_key) = 0
+)`, expr),
 	}
+}
+
+// clickDayLayout formats the UTC day of a click.
+const clickDayLayout = "2006-01-02"
 
-	return res
+// isExpired reports whether a link expiring at expiresAt has expired by now.
+func isExpired(expiresAt, now time.Time) bool {
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
 }
 
-func (s MemoryStorage) AddURL(link ShortLink) error {
-	existing, _ := s.GetURLByOriginalURL(link.OriginalURL)
-	if existing != "" {
-		return &RecordDuplicateError{param: "OriginalID", value: link.OriginalURL}
-	}
-	s.ShortenURLs[link.ID] = link.OriginalURL
-	userURLs := s.GetUserURLs(link.UserID)
-	if len(userURLs) == 0 {
-		s.UserLinks[link.UserID] = make([]string, 0)
-	}
-	s.UserLinks[link.UserID] = append(s.UserLinks[link.UserID], link.ID)
+// Statuses of the links of a batch, see BatchResult.
+const (
+	BatchCreated  = "created"
+	BatchExisting = "existing"
+)
 
-	return nil
+// BatchResult tells what AddURLBatch did with a link of the batch: either the
+// link was stored under its own ID, or its original URL had already been
+// shortened and ID is the existing short ID.
+type BatchResult struct {
+	ID     string
+	Status string
 }
 
-func (s MemoryStorage) AddURLBatch(links []ShortLink) error {
-	for _, link := range links {
-		err := s.AddURL(link)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+type RecordDuplicateError struct {
+	param string
+	value string
 }
 
-func (s MemoryStorage) CleanUp(c app.Config) {
-	file, err := os.OpenFile(c.FileStoragePath, os.O_WRONLY, 0664)
-	if err != nil {
-		return
-	}
-	defer file.Close()
+func (e *RecordDuplicateError) Error() string {
+	return fmt.Sprintf("Record with same param %s with value %s already exists", e.param, e.value)
+}
 
-	writer := csv.NewWriter(file)
+// RecordExpiredError is returned for a link past its expiry time.
+type RecordExpiredError struct {
+	ID string
+}
 
-	var pairs [][]string
-	for key, value := range s.ShortenURLs {
-		pairs = append(pairs, []string{key, value})
-	}
+func (e *RecordExpiredError) Error() string {
+	return fmt.Sprintf("Record with ID %s has expired", e.ID)
+}
 
-	err = writer.WriteAll(pairs)
-	if err != nil {
-		return
-	}
+// RecordIDCollisionError is returned when a new link gets a short ID which
+// is already taken by another link.
+type RecordIDCollisionError struct {
+	ID string
+}
 
-	writer.Flush()
+func (e *RecordIDCollisionError) Error() string {
+	return fmt.Sprintf("Record with ID %s already exists", e.ID)
 }
 
-type ShortenURLEntity struct {
-	ShortURL    string
-	OriginalURL string
-	UserID      string
+// LinkIDWalker is implemented by storages which can list the short IDs of
+// the links they hold, deleted ones included. fn is called once per ID, in
+// no particular order.
+type LinkIDWalker interface {
+	WalkLinkIDs(ctx context.Context, fn func(ID string)) error
 }
 
-func (s DBStorage) GetURLByID(ID string) (string, error) {
-	var res struct {
-		originalURL string
-		isDeleted   bool
-	}
+// PoolStats describes the connections of a pooled storage.
+type PoolStats struct {
+	Total    int32
+	Idle     int32
+	Acquired int32
+	Max      int32
+}
 
-	err := s.DBConn.QueryRow(context.Background(), "SELECT original_url, is_deleted FROM shorten_urls WHERE id = $1", ID).Scan(&res.originalURL, &res.isDeleted)
-	if err == pgx.ErrNoRows {
-		return "", nil
-	}
-	if err != nil {
-		return "", err
-	}
+// Saturated reports whether every connection the pool may open is in use.
+func (ps PoolStats) Saturated() bool {
+	return ps.Max > 0 && ps.Acquired >= ps.Max
+}
 
-	if res.isDeleted {
-		return "", &RecordSoftDeletedError{ID}
-	}
+// PoolStatter is implemented by storages backed by a connection pool.
+type PoolStatter interface {
+	PoolStats() PoolStats
+}
 
-	return res.originalURL, nil
+// SchemaVersioner is implemented by storages with a migrated schema. It
+// returns the applied schema version and the latest version known to this
+// build.
+type SchemaVersioner interface {
+	SchemaVersion(ctx context.Context) (current, latest int, err error)
 }
 
-func (s DBStorage) GetURLByOriginalURL(OriginalURL string) (string, error) {
-	var res string
-	err := s.DBConn.QueryRow(context.Background(), "SELECT id FROM shorten_urls WHERE original_url = $1", OriginalURL).Scan(&res)
-	if err == pgx.ErrNoRows {
-		return res, nil
-	}
-	if err != nil {
-		return "", err
-	}
+type RecordSoftDeletedError struct {
+	ID string
+}
 
-	return res, nil
+func (e *RecordSoftDeletedError) Error() string {
+	return fmt.Sprintf("Record with ID %s was marked as deleted", e.ID)
 }
 
-func (s DBStorage) GetUserURLs(userID string) []ShortLink {
-	res := make([]ShortLink, 0)
-	rows, err := s.DBConn.Query(context.Background(), "SELECT id, original_url FROM shorten_urls WHERE user_id = $1", userID)
-	if err != nil {
-		return res
-	}
-	defer rows.Close()
+// ErrStorageClosed is returned by the operations of a storage after CleanUp.
+var ErrStorageClosed = errors.New("storage is closed")
 
-	for rows.Next() {
-		var r ShortLink
-		err := rows.Scan(&r.ID, &r.OriginalURL)
-		if err != nil {
-			return nil
-		}
-		res = append(res, r)
-	}
+// OperationTimeoutError is returned when a storage operation does not finish
+// before its deadline.
+type OperationTimeoutError struct {
+	Op  string
+	Err error
+}
 
-	return res
+func (e *OperationTimeoutError) Error() string {
+	return fmt.Sprintf("Operation %s timed out: %v", e.Op, e.Err)
 }
 
-func (s DBStorage) AddURL(link ShortLink) error {
-	_, err := s.DBConn.Exec(context.Background(), "INSERT INTO shorten_urls VALUES ($1, $2, $3)", link.ID, link.OriginalURL, link.UserID)
-	if err != nil {
-		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) {
-			if pgErr.Code == pgerrcode.UniqueViolation {
-				return &RecordDuplicateError{param: "original_url", value: link.OriginalURL}
-			}
-		}
-		return err
-	}
+func (e *OperationTimeoutError) Unwrap() error {
+	return e.Err
+}
 
-	return nil
+// StorageUnavailableError is returned when the storage can't serve the
+// operation at all, e.g. no pooled connection became free in time.
+type StorageUnavailableError struct {
+	Err error
 }
 
-func (s DBStorage) AddURLBatch(links []ShortLink) error {
-	rows := make([][]interface{}, 0)
-	for _, link := range links {
-		rows = append(rows, []interface{}{link.ID, link.OriginalURL, link.UserID})
-	}
-	_, err := s.DBConn.CopyFrom(
-		context.Background(),
-		pgx.Identifier{"shorten_urls"},
-		[]string{"id", "original_url", "user_id"},
-		pgx.CopyFromRows(rows),
-	)
+func (e *StorageUnavailableError) Error() string {
+	return fmt.Sprintf("Storage is unavailable: %v", e.Err)
+}
 
-	if err != nil {
-		return err
-	}
+func (e *StorageUnavailableError) Unwrap() error {
+	return e.Err
+}
 
-	return nil
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
 }
 
-func (s DBStorage) CleanUp(c app.Config) {
-	err := s.DBConn.Close(context.Background())
-	if err != nil {
-		return
+func wrapTimeout(op string, err error) error {
+	if err == nil {
+		return nil
 	}
+	if errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err) {
+		return &OperationTimeoutError{Op: op, Err: err}
+	}
+	return err
 }
 
-func (s MemoryStorage) DeleteUserURLs(IDs []string, userID string) error {
-	return nil
+type ShortenURLEntity struct {
+	ShortURL    string
+	OriginalURL string
+	UserID      string
 }
 
-func (s DBStorage) DeleteUserURLs(IDs []string, userID string) error {
-	preparedIDs := &pgtype.TextArray{}
-	err := preparedIDs.Set(IDs)
-	if err != nil {
-		return err
+const (
+	ModeAuto     = "auto"
+	ModePostgres = "postgres"
+	ModeSQLite   = "sqlite"
+	ModeFile     = "file"
+	ModeMemory   = "memory"
+)
+
+// InitStorage initializes the backend selected by c.StorageMode. In auto mode
+// the database DSN is used when configured (SQLite for a sqlite:// DSN,
+// Postgres otherwise), then the file storage, then the plain memory storage.
+// The selected backend is never silently replaced by another one: if it
+// can't be initialized an error is returned.
+func InitStorage(c app.Config) (Repository, error) {
+	switch c.DedupScope {
+	case "", DedupGlobal, DedupPerUser, DedupNone:
+	default:
+		return nil, fmt.Errorf("unknown dedup scope %q", c.DedupScope)
 	}
-	_, err = s.DBConn.Exec(context.Background(), "UPDATE shorten_urls SET is_deleted = true WHERE user_id = $1 AND id = ANY($2)", userID, preparedIDs)
-	return err
-}
 
-func InitStorage(c app.Config) Repository {
-	if c.DatabaseDSN != "" {
-		conn, err := pgx.Connect(context.Background(), c.DatabaseDSN)
+	mode := c.StorageMode
+	if mode == "" || mode == ModeAuto {
+		switch {
+		case isSQLiteDSN(c.DatabaseDSN):
+			mode = ModeSQLite
+		case c.DatabaseDSN != "":
+			mode = ModePostgres
+		case c.FileStoragePath != "":
+			mode = ModeFile
+		default:
+			mode = ModeMemory
+		}
+	}
+
+	switch mode {
+	case ModePostgres:
+		if c.DatabaseDSN == "" {
+			return nil, fmt.Errorf("storage mode %s requires a database DSN", mode)
+		}
+		var dbSt *DBStorage
+		err := retry(c, mode, func() error {
+			var err error
+			dbSt, err = initDBStorage(c)
+			return err
+		})
 		if err != nil {
-			return initMemoryStorage(c)
+			return nil, fmt.Errorf("init %s storage: %w", mode, err)
 		}
-		dbSt := &DBStorage{
-			DBConn: conn,
+		return dbSt, nil
+	case ModeSQLite:
+		if !isSQLiteDSN(c.DatabaseDSN) {
+			return nil, fmt.Errorf("storage mode %s requires a %s database DSN", mode, sqliteScheme)
 		}
-
-		_, err = dbSt.DBConn.Exec(context.Background(), "CREATE TABLE IF NOT EXISTS shorten_urls (id varchar(36), original_url varchar(255), user_id varchar(36), is_deleted boolean DEFAULT false);")
+		var sqlSt *SQLiteStorage
+		err := retry(c, mode, func() error {
+			var err error
+			sqlSt, err = initSQLiteStorage(c)
+			return err
+		})
 		if err != nil {
-			return initMemoryStorage(c)
+			return nil, fmt.Errorf("init %s storage: %w", mode, err)
 		}
-		_, err = dbSt.DBConn.Exec(context.Background(), "CREATE UNIQUE INDEX IF NOT EXISTS original_url_idx ON shorten_urls (original_url);")
+		return sqlSt, nil
+	case ModeFile:
+		if c.FileStoragePath == "" {
+			return nil, fmt.Errorf("storage mode %s requires a file storage path", mode)
+		}
+		var memSt *MemoryStorage
+		err := retry(c, mode, func() error {
+			var err error
+			memSt, err = initMemoryStorage(c, c.FileStoragePath)
+			return err
+		})
 		if err != nil {
-			return initMemoryStorage(c)
+			return nil, fmt.Errorf("init %s storage: %w", mode, err)
 		}
-
-		return dbSt
+		return memSt, nil
+	case ModeMemory:
+		return initMemoryStorage(c, "")
 	}
 
-	return initMemoryStorage(c)
+	return nil, fmt.Errorf("unknown storage mode %q", c.StorageMode)
 }
 
-func initMemoryStorage(c app.Config) Repository {
-	memSt := &MemoryStorage{
-		ShortenURLs: make(map[string]string),
-		UserLinks:   make(map[string][]string),
+// retry calls init up to c.StorageInitRetries times, doubling the pause
+// between attempts starting from c.StorageInitBackoff.
+func retry(c app.Config, mode string, init func() error) error {
+	attempts := c.StorageInitRetries
+	if attempts < 1 {
+		attempts = 1
 	}
+	backoff := c.StorageInitBackoff
 
-	file, err := os.OpenFile(c.FileStoragePath, os.O_RDONLY|os.O_CREATE, 0664)
-	if err != nil {
-		return memSt
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = init()
+		if err == nil {
+			return nil
+		}
+		log.Printf("storage: %s init attempt %d/%d failed: %v", mode, attempt, attempts, err)
+		if attempt < attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
 	}
-	defer file.Close()
 
-	records, err := csv.NewReader(file).ReadAll()
+	return err
+}
+
+func initDBStorage(c app.Config) (*DBStorage, error) {
+	dbSt, err := NewDBStorage(context.Background(), c)
 	if err != nil {
-		return memSt
+		return nil, err
 	}
 
-	for _, line := range records {
-		memSt.ShortenURLs[line[0]] = line[1]
+	_, err = dbSt.Migrate(context.Background(), "up")
+	if err == nil {
+		err = dbSt.applyDedupScope(context.Background())
+	}
+	if err != nil {
+		dbSt.Pool.Close()
+		return nil, err
 	}
 
-	return memSt
+	return dbSt, nil
 }
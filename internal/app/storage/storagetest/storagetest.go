@@ -0,0 +1,624 @@
+// Package storagetest holds the conformance tests every storage.Repository
+// implementation has to pass.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app/storage"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns a ready Repository for a single test. It is expected to
+// register the repository's CleanUp with t.Cleanup.
+type Factory func(t *testing.T) storage.Repository
+
+// RunRepositoryTests runs the conformance suite against the repositories
+// produced by newRepo. Records are created with random IDs, URLs and users,
+// so the suite may run against a storage that already holds data. The
+// repositories must deduplicate the links of a user, which both the global
+// and the per-user dedup scope do.
+func RunRepositoryTests(t *testing.T, newRepo Factory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s storage.Repository)
+	}{
+		{"Ping", testPing},
+		{"AddAndGet", testAddAndGet},
+		{"NotFound", testNotFound},
+		{"DuplicateOriginalURL", testDuplicateOriginalURL},
+		{"IDCollision", testIDCollision},
+		{"Batch", testBatch},
+		{"BatchDuplicates", testBatchDuplicates},
+		{"BatchIsAtomic", testBatchIsAtomic},
+		{"UserURLs", testUserURLs},
+		{"Delete", testDelete},
+		{"Restore", testRestore},
+		{"UpdateURL", testUpdateURL},
+		{"PurgeDeleted", testPurgeDeleted},
+		{"Expiry", testExpiry},
+		{"PurgeExpired", testPurgeExpired},
+		{"Clicks", testClicks},
+		{"ServiceStats", testServiceStats},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.run(t, newRepo(t))
+		})
+	}
+}
+
+// ScopedFactory returns a ready Repository deduplicating links under scope,
+// one of the storage.Dedup scopes. See Factory.
+type ScopedFactory func(t *testing.T, scope string) storage.Repository
+
+// RunDedupScopeTests checks that the repositories produced by newRepo tell
+// duplicates apart the way their dedup scope says.
+func RunDedupScopeTests(t *testing.T, newRepo ScopedFactory) {
+	tests := []struct {
+		scope string
+		// Whether a link duplicates one of the same user, and one of
+		// another user.
+		sameUser, otherUser bool
+	}{
+		{storage.DedupGlobal, true, true},
+		{storage.DedupPerUser, true, false},
+		{storage.DedupNone, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			s := newRepo(t, tt.scope)
+			ctx := context.Background()
+			link := newLink(uuid.NewV4().String())
+			require.NoError(t, s.AddURL(ctx, link))
+
+			// Retargeting a link onto the URL is a duplicate the same way.
+			retargeted := newLink(uuid.NewV4().String())
+			require.NoError(t, s.AddURL(ctx, retargeted))
+			_, err := s.UpdateURL(ctx, retargeted.ID, retargeted.UserID, link.OriginalURL)
+			if tt.otherUser {
+				var rde *storage.RecordDuplicateError
+				assert.True(t, errors.As(err, &rde), "want RecordDuplicateError, got %v", err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			for _, c := range []struct {
+				name      string
+				userID    string
+				duplicate bool
+			}{
+				{"same user", link.UserID, tt.sameUser},
+				{"other user", uuid.NewV4().String(), tt.otherUser},
+			} {
+				dup := newLink(c.userID)
+				dup.OriginalURL = link.OriginalURL
+				err := s.AddURL(ctx, dup)
+				batched := newLink(c.userID)
+				batched.OriginalURL = link.OriginalURL
+				res, batchErr := s.AddURLBatch(ctx, []storage.ShortLink{batched})
+				require.NoError(t, batchErr, c.name)
+				ID, getErr := s.GetURLByOriginalURL(ctx, link.OriginalURL, c.userID)
+				require.NoError(t, getErr, c.name)
+
+				if c.duplicate {
+					var rde *storage.RecordDuplicateError
+					assert.True(t, errors.As(err, &rde), "%s: want RecordDuplicateError, got %v", c.name, err)
+					assert.Equal(t, []storage.BatchResult{{ID: link.ID, Status: storage.BatchExisting}}, res, c.name)
+					assert.Equal(t, link.ID, ID, c.name)
+					continue
+				}
+				// The link of the user is not a duplicate, but it has
+				// duplicates of its own unless the scope has none.
+				assert.NoError(t, err, c.name)
+				if tt.scope == storage.DedupNone {
+					assert.Equal(t, []storage.BatchResult{{ID: batched.ID, Status: storage.BatchCreated}}, res, c.name)
+					assert.Empty(t, ID, c.name)
+				} else {
+					assert.Equal(t, []storage.BatchResult{{ID: dup.ID, Status: storage.BatchExisting}}, res, c.name)
+					assert.Equal(t, dup.ID, ID, c.name)
+				}
+			}
+		})
+	}
+}
+
+func newLink(userID string) storage.ShortLink {
+	ID := uuid.NewV4().String()
+	return storage.ShortLink{
+		ID:          ID,
+		OriginalURL: fmt.Sprintf("https://example.org/%s", ID),
+		UserID:      userID,
+	}
+}
+
+func testPing(t *testing.T, s storage.Repository) {
+	assert.NoError(t, s.Ping(context.Background()))
+}
+
+func testAddAndGet(t *testing.T, s storage.Repository) {
+	ctx := context.Background()
+	link := newLink(uuid.NewV4().String())
+	require.NoError(t, s.AddURL(ctx, link))
+
+	URL, err := s.GetURLByID(ctx, link.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, link.OriginalURL, URL)
+
+	ID, err := s.GetURLByOriginalURL(ctx, link.OriginalURL, link.UserID)
+	assert.NoError(t, err)
+	assert.Equal(t, link.ID, ID)
+
+	stored, err := s.GetLinkByID(ctx, link.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, link, stored)
+}
+
+func testNotFound(t *testing.T, s storage.Repository) {
+	ctx := context.Background()
+
+	URL, err := s.GetURLByID(ctx, uuid.NewV4().String())
+	assert.NoError(t, err)
+	assert.Empty(t, URL)
+
+	ID, err := s.GetURLByOriginalURL(ctx, fmt.Sprintf("https://example.org/%s", uuid.NewV4()), uuid.NewV4().String())
+	assert.NoError(t, err)
+	assert.Empty(t, ID)
+
+	links, err := s.GetUserURLs(ctx, uuid.NewV4().String())
+	assert.NoError(t, err)
+	assert.Empty(t, links)
+
+	link, err := s.GetLinkByID(ctx, uuid.NewV4().String())
+	assert.NoError(t, err)
+	assert.Equal(t, storage.ShortLink{}, link)
+}
+
+func testDuplicateOriginalURL(t *testing.T, s storage.Repository) {
+	ctx := context.Background()
+	link := newLink(uuid.NewV4().String())
+	require.NoError(t, s.AddURL(ctx, link))
+
+	dup := newLink(link.UserID)
+	dup.OriginalURL = link.OriginalURL
+	err := s.AddURL(ctx, dup)
+	var rde *storage.RecordDuplicateError
+	assert.True(t, errors.As(err, &rde), "want RecordDuplicateError, got %v", err)
+
+	ID, err := s.GetURLByOriginalURL(ctx, link.OriginalURL, link.UserID)
+	assert.NoError(t, err)
+	assert.Equal(t, link.ID, ID)
+
+	URL, err := s.GetURLByID(ctx, dup.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, URL)
+}
+
+func testIDCollision(t *testing.T, s storage.Repository) {
+	ctx := context.Background()
+	link := newLink(uuid.NewV4().String())
+	require.NoError(t, s.AddURL(ctx, link))
+
+	clash := newLink(uuid.NewV4().String())
+	clash.ID = link.ID
+	err := s.AddURL(ctx, clash)
+	var ice *storage.RecordIDCollisionError
+	assert.True(t, errors.As(err, &ice), "want RecordIDCollisionError, got %v", err)
+
+	URL, err := s.GetURLByID(ctx, link.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, link.OriginalURL, URL)
+}
+
+func testBatch(t *testing.T, s storage.Repository) {
+	ctx := context.Background()
+	userID := uuid.NewV4().String()
+	links := []storage.ShortLink{newLink(userID), newLink(userID), newLink(userID)}
+	results, err := s.AddURLBatch(ctx, links)
+	require.NoError(t, err)
+	for n, link := range links {
+		assert.Equal(t, storage.BatchResult{ID: link.ID, Status: storage.BatchCreated}, results[n])
+	}
+
+	for _, link := range links {
+		URL, err := s.GetURLByID(ctx, link.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, link.OriginalURL, URL)
+	}
+
+	stored, err := s.GetUserURLs(ctx, userID)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, links, stored)
+}
+
+func testBatchDuplicates(t *testing.T, s storage.Repository) {
+	ctx := context.Background()
+	userID := uuid.NewV4().String()
+	existing := newLink(userID)
+	require.NoError(t, s.AddURL(ctx, existing))
+
+	stored := newLink(userID)
+	again := newLink(userID)
+	again.OriginalURL = stored.OriginalURL
+	old := newLink(userID)
+	old.OriginalURL = existing.OriginalURL
+
+	results, err := s.AddURLBatch(ctx, []storage.ShortLink{stored, again, old})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.BatchResult{
+		{ID: stored.ID, Status: storage.BatchCreated},
+		{ID: stored.ID, Status: storage.BatchExisting},
+		{ID: existing.ID, Status: storage.BatchExisting},
+	}, results)
+
+	for _, ID := range []string{again.ID, old.ID} {
+		URL, err := s.GetURLByID(ctx, ID)
+		assert.NoError(t, err)
+		assert.Empty(t, URL)
+	}
+}
+
+func testBatchIsAtomic(t *testing.T, s storage.Repository) {
+	ctx := context.Background()
+	userID := uuid.NewV4().String()
+	existing := newLink(userID)
+	require.NoError(t, s.AddURL(ctx, existing))
+
+	fresh := newLink(userID)
+	clash := newLink(userID)
+	clash.ID = existing.ID
+	_, err := s.AddURLBatch(ctx, []storage.ShortLink{fresh, clash})
+	var ice *storage.RecordIDCollisionError
+	assert.True(t, errors.As(err, &ice), "want RecordIDCollisionError, got %v", err)
+
+	URL, err := s.GetURLByID(ctx, fresh.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, URL)
+}
+
+func testUserURLs(t *testing.T, s storage.Repository) {
+	ctx := context.Background()
+	userID := uuid.NewV4().String()
+	own := []storage.ShortLink{newLink(userID), newLink(userID)}
+	for _, link := range own {
+		require.NoError(t, s.AddURL(ctx, link))
+	}
+	require.NoError(t, s.AddURL(ctx, newLink(uuid.NewV4().String())))
+
+	stored, err := s.GetUserURLs(ctx, userID)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, own, stored)
+}
+
+func testDelete(t *testing.T, s storage.Repository) {
+	ctx := context.Background()
+	userID := uuid.NewV4().String()
+	deleted := newLink(userID)
+	kept := newLink(userID)
+	foreign := newLink(uuid.NewV4().String())
+	for _, link := range []storage.ShortLink{deleted, kept, foreign} {
+		require.NoError(t, s.AddURL(ctx, link))
+	}
+
+	IDs, err := s.DeleteUserURLs(ctx, []string{deleted.ID, foreign.ID, uuid.NewV4().String()}, userID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{deleted.ID}, IDs)
+
+	_, err = s.GetURLByID(ctx, deleted.ID)
+	var rde *storage.RecordSoftDeletedError
+	assert.True(t, errors.As(err, &rde), "want RecordSoftDeletedError, got %v", err)
+
+	for _, link := range []storage.ShortLink{kept, foreign} {
+		URL, err := s.GetURLByID(ctx, link.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, link.OriginalURL, URL)
+	}
+
+	stored, err := s.GetLinkByID(ctx, deleted.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, deleted, stored)
+
+	// Deleting again is not an error, and reports the link again.
+	IDs, err = s.DeleteUserURLs(ctx, []string{deleted.ID}, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{deleted.ID}, IDs)
+
+	// Deleted links stay in the owner's list.
+	links, err := s.GetUserURLs(ctx, userID)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []storage.ShortLink{deleted, kept}, links)
+}
+
+// expiresIn returns an expiry time which survives the round trip through
+// every storage unchanged.
+func expiresIn(d time.Duration) time.Time {
+	return time.Now().UTC().Add(d).Truncate(time.Millisecond)
+}
+
+func testExpiry(t *testing.T, s storage.Repository) {
+	ctx := context.Background()
+	userID := uuid.NewV4().String()
+	live := newLink(userID)
+	live.ExpiresAt = expiresIn(time.Hour)
+	expired := newLink(userID)
+	expired.ExpiresAt = expiresIn(-time.Hour)
+	for _, link := range []storage.ShortLink{live, expired} {
+		require.NoError(t, s.AddURL(ctx, link))
+	}
+
+	URL, err := s.GetURLByID(ctx, live.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, live.OriginalURL, URL)
+
+	_, err = s.GetURLByID(ctx, expired.ID)
+	var ree *storage.RecordExpiredError
+	assert.True(t, errors.As(err, &ree), "want RecordExpiredError, got %v", err)
+
+	stored, err := s.GetLinkByID(ctx, expired.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, expired, stored)
+
+	links, err := s.GetUserURLs(ctx, userID)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []storage.ShortLink{live, expired}, links)
+
+	// The original URL of an expired link can be shortened again.
+	again := newLink(userID)
+	again.OriginalURL = expired.OriginalURL
+	require.NoError(t, s.AddURL(ctx, again))
+	ID, err := s.GetURLByOriginalURL(ctx, expired.OriginalURL, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, again.ID, ID)
+
+	inBatch := newLink(userID)
+	inBatch.ExpiresAt = expiresIn(-time.Hour)
+	require.NoError(t, s.AddURL(ctx, inBatch))
+	batched := newLink(userID)
+	batched.OriginalURL = inBatch.OriginalURL
+	results, err := s.AddURLBatch(ctx, []storage.ShortLink{batched})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.BatchResult{{ID: batched.ID, Status: storage.BatchCreated}}, results)
+}
+
+func testPurgeExpired(t *testing.T, s storage.Repository) {
+	ctx := context.Background()
+	userID := uuid.NewV4().String()
+	live := newLink(userID)
+	live.ExpiresAt = expiresIn(time.Hour)
+	expired := newLink(userID)
+	expired.ExpiresAt = expiresIn(-time.Hour)
+	forever := newLink(userID)
+	for _, link := range []storage.ShortLink{live, expired, forever} {
+		require.NoError(t, s.AddURL(ctx, link))
+	}
+
+	n, err := s.PurgeExpired(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, n, int64(1))
+
+	stored, err := s.GetLinkByID(ctx, expired.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.ShortLink{}, stored)
+
+	links, err := s.GetUserURLs(ctx, userID)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []storage.ShortLink{live, forever}, links)
+}
+
+func testRestore(t *testing.T, s storage.Repository) {
+	ctx := context.Background()
+	userID := uuid.NewV4().String()
+	deleted := newLink(userID)
+	kept := newLink(userID)
+	foreign := newLink(uuid.NewV4().String())
+	for _, link := range []storage.ShortLink{deleted, kept, foreign} {
+		require.NoError(t, s.AddURL(ctx, link))
+	}
+	_, err := s.DeleteUserURLs(ctx, []string{deleted.ID}, userID)
+	require.NoError(t, err)
+	_, err = s.DeleteUserURLs(ctx, []string{foreign.ID}, foreign.UserID)
+	require.NoError(t, err)
+
+	// Out of the grace window.
+	IDs, err := s.RestoreUserURLs(ctx, []string{deleted.ID}, userID, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, IDs)
+
+	IDs, err = s.RestoreUserURLs(ctx, []string{deleted.ID, kept.ID, foreign.ID, uuid.NewV4().String()}, userID, time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{deleted.ID}, IDs)
+
+	URL, err := s.GetURLByID(ctx, deleted.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, deleted.OriginalURL, URL)
+
+	_, err = s.GetURLByID(ctx, foreign.ID)
+	var rde *storage.RecordSoftDeletedError
+	assert.True(t, errors.As(err, &rde), "want RecordSoftDeletedError, got %v", err)
+
+	// A restored link is deleted again with a new deletion time.
+	_, err = s.DeleteUserURLs(ctx, []string{deleted.ID}, userID)
+	require.NoError(t, err)
+	IDs, err = s.RestoreUserURLs(ctx, []string{deleted.ID}, userID, time.Now().Add(-time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{deleted.ID}, IDs)
+}
+
+func testUpdateURL(t *testing.T, s storage.Repository) {
+	ctx := context.Background()
+	userID := uuid.NewV4().String()
+	link := newLink(userID)
+	other := newLink(userID)
+	deleted := newLink(userID)
+	for _, l := range []storage.ShortLink{link, other, deleted} {
+		require.NoError(t, s.AddURL(ctx, l))
+	}
+	_, err := s.DeleteUserURLs(ctx, []string{deleted.ID}, userID)
+	require.NoError(t, err)
+
+	history, err := s.GetURLHistory(ctx, link.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.LinkVersion{{Version: 1, OriginalURL: link.OriginalURL}}, withoutTimes(history))
+
+	// Setting the current URL again changes nothing, the history included.
+	version, err := s.UpdateURL(ctx, link.ID, userID, link.OriginalURL)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version)
+	unchanged, err := s.GetURLHistory(ctx, link.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, history, unchanged)
+
+	second := link.OriginalURL + "/second"
+	version, err = s.UpdateURL(ctx, link.ID, userID, second)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, version)
+	version, err = s.UpdateURL(ctx, link.ID, userID, link.OriginalURL)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, version)
+	version, err = s.UpdateURL(ctx, link.ID, userID, second)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, version)
+
+	URL, err := s.GetURLByID(ctx, link.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, second, URL)
+	ID, err := s.GetURLByOriginalURL(ctx, second, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, link.ID, ID)
+	// The URL the link left is free again.
+	ID, err = s.GetURLByOriginalURL(ctx, link.OriginalURL, userID)
+	assert.NoError(t, err)
+	assert.Empty(t, ID)
+
+	history, err = s.GetURLHistory(ctx, link.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.LinkVersion{
+		{Version: 1, OriginalURL: link.OriginalURL},
+		{Version: 2, OriginalURL: second},
+		{Version: 3, OriginalURL: link.OriginalURL},
+		{Version: 4, OriginalURL: second},
+	}, withoutTimes(history))
+	for _, v := range history[1:] {
+		assert.WithinDuration(t, time.Now(), v.CreatedAt, time.Minute)
+	}
+
+	_, err = s.UpdateURL(ctx, link.ID, userID, other.OriginalURL)
+	var rde *storage.RecordDuplicateError
+	assert.True(t, errors.As(err, &rde), "want RecordDuplicateError, got %v", err)
+
+	_, err = s.UpdateURL(ctx, deleted.ID, userID, deleted.OriginalURL+"/new")
+	var rsde *storage.RecordSoftDeletedError
+	assert.True(t, errors.As(err, &rsde), "want RecordSoftDeletedError, got %v", err)
+
+	version, err = s.UpdateURL(ctx, link.ID, uuid.NewV4().String(), link.OriginalURL+"/foreign")
+	assert.NoError(t, err)
+	assert.Zero(t, version)
+
+	history, err = s.GetURLHistory(ctx, uuid.NewV4().String())
+	assert.NoError(t, err)
+	assert.Nil(t, history)
+}
+
+// withoutTimes drops the times of versions, which not every storage knows
+// for version 1.
+func withoutTimes(history []storage.LinkVersion) []storage.LinkVersion {
+	res := make([]storage.LinkVersion, len(history))
+	for n, v := range history {
+		res[n] = storage.LinkVersion{Version: v.Version, OriginalURL: v.OriginalURL}
+	}
+	return res
+}
+
+func testPurgeDeleted(t *testing.T, s storage.Repository) {
+	ctx := context.Background()
+	userID := uuid.NewV4().String()
+	deleted := newLink(userID)
+	kept := newLink(userID)
+	for _, link := range []storage.ShortLink{deleted, kept} {
+		require.NoError(t, s.AddURL(ctx, link))
+	}
+	_, err := s.DeleteUserURLs(ctx, []string{deleted.ID}, userID)
+	require.NoError(t, err)
+
+	// Still in the grace window.
+	_, err = s.PurgeDeleted(ctx, time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	stored, err := s.GetLinkByID(ctx, deleted.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, deleted, stored)
+
+	n, err := s.PurgeDeleted(ctx, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, n, int64(1))
+
+	stored, err = s.GetLinkByID(ctx, deleted.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.ShortLink{}, stored)
+
+	links, err := s.GetUserURLs(ctx, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.ShortLink{kept}, links)
+}
+
+func testClicks(t *testing.T, s storage.Repository) {
+	ctx := context.Background()
+	link := newLink(uuid.NewV4().String())
+	require.NoError(t, s.AddURL(ctx, link))
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	yesterday := today.AddDate(0, 0, -1)
+	lastWeek := today.AddDate(0, 0, -7)
+	click := func(ID string, at time.Time) storage.Click {
+		return storage.Click{LinkID: ID, At: at, Referrer: "https://example.com", UserAgent: "test", IPHash: "hash"}
+	}
+	require.NoError(t, s.AddClicks(ctx, []storage.Click{
+		click(link.ID, lastWeek.Add(time.Hour)),
+		click(link.ID, yesterday.Add(time.Hour)),
+		click(link.ID, yesterday.Add(23*time.Hour)),
+		click(link.ID, today.Add(time.Minute)),
+		click(uuid.NewV4().String(), today),
+	}))
+
+	stats, err := s.GetClickStats(ctx, link.ID, yesterday.Add(12*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, storage.ClickStats{
+		Total: 4,
+		Daily: []storage.DailyClicks{{Day: yesterday, Clicks: 2}, {Day: today, Clicks: 1}},
+	}, stats)
+
+	stats, err = s.GetClickStats(ctx, uuid.NewV4().String(), lastWeek)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.ClickStats{}, stats)
+}
+
+func testServiceStats(t *testing.T, s storage.Repository) {
+	ctx := context.Background()
+	before, err := s.GetServiceStats(ctx)
+	require.NoError(t, err)
+
+	userID := uuid.NewV4().String()
+	kept, deleted := newLink(userID), newLink(userID)
+	require.NoError(t, s.AddURL(ctx, kept))
+	require.NoError(t, s.AddURL(ctx, deleted))
+	_, err = s.DeleteUserURLs(ctx, []string{deleted.ID}, userID)
+	require.NoError(t, err)
+	require.NoError(t, s.AddClicks(ctx, []storage.Click{
+		{LinkID: kept.ID, At: time.Now()},
+		{LinkID: kept.ID, At: time.Now()},
+	}))
+
+	after, err := s.GetServiceStats(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.ServiceStats{
+		URLs:    before.URLs + 1,
+		Users:   before.Users + 1,
+		Deleted: before.Deleted + 1,
+		Clicks:  before.Clicks + 2,
+	}, after)
+}
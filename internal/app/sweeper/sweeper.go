@@ -0,0 +1,84 @@
+// Package sweeper periodically purges expired links, and deleted links past
+// their grace window, from the storage.
+package sweeper
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app/storage"
+)
+
+type Sweeper struct {
+	storage  storage.Repository
+	interval time.Duration
+	grace    time.Duration
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// Start purges the expired links of s, and the links deleted more than grace
+// ago, every interval until Stop is called. A non-positive interval disables
+// the sweeper; a non-positive grace keeps the deleted links.
+func Start(s storage.Repository, interval time.Duration, grace time.Duration) *Sweeper {
+	sw := &Sweeper{
+		storage:  s,
+		interval: interval,
+		grace:    grace,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if interval <= 0 {
+		close(sw.done)
+		return sw
+	}
+
+	go sw.run()
+
+	return sw
+}
+
+func (sw *Sweeper) run() {
+	defer close(sw.done)
+
+	t := time.NewTicker(sw.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-sw.stop:
+			return
+		case <-t.C:
+			sw.sweep()
+		}
+	}
+}
+
+func (sw *Sweeper) sweep() {
+	now := time.Now()
+	n, err := sw.storage.PurgeExpired(context.Background(), now)
+	if err != nil {
+		log.Printf("sweeper: purge expired links: %v", err)
+	} else if n > 0 {
+		log.Printf("sweeper: purged %d expired links", n)
+	}
+
+	if sw.grace <= 0 {
+		return
+	}
+	n, err = sw.storage.PurgeDeleted(context.Background(), now.Add(-sw.grace))
+	if err != nil {
+		log.Printf("sweeper: purge deleted links: %v", err)
+	} else if n > 0 {
+		log.Printf("sweeper: purged %d deleted links", n)
+	}
+}
+
+// Stop stops the sweeper and waits for a running purge to finish.
+func (sw *Sweeper) Stop() {
+	sw.stopOnce.Do(func() { close(sw.stop) })
+	<-sw.done
+}
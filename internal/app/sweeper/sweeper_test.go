@@ -0,0 +1,57 @@
+package sweeper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JamesDeGreese/ya_golang/internal/app/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSweeperPurgesExpiredLinks(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemoryStorage()
+	require.NoError(t, s.AddURL(ctx, storage.ShortLink{ID: "a", OriginalURL: "https://example.org/a", ExpiresAt: time.Now().Add(-time.Minute)}))
+	require.NoError(t, s.AddURL(ctx, storage.ShortLink{ID: "b", OriginalURL: "https://example.org/b"}))
+
+	sw := Start(s, 10*time.Millisecond, 0)
+	defer sw.Stop()
+
+	assert.Eventually(t, func() bool {
+		link, err := s.GetLinkByID(ctx, "a")
+		return err == nil && link.ID == ""
+	}, time.Second, 10*time.Millisecond)
+
+	URL, err := s.GetURLByID(ctx, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.org/b", URL)
+}
+
+func TestSweeperPurgesDeletedLinksAfterGrace(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemoryStorage()
+	require.NoError(t, s.AddURL(ctx, storage.ShortLink{ID: "a", OriginalURL: "https://example.org/a", UserID: "u1"}))
+	require.NoError(t, s.AddURL(ctx, storage.ShortLink{ID: "b", OriginalURL: "https://example.org/b", UserID: "u1"}))
+	_, err := s.DeleteUserURLs(ctx, []string{"a"}, "u1")
+	require.NoError(t, err)
+
+	sw := Start(s, 10*time.Millisecond, 20*time.Millisecond)
+	defer sw.Stop()
+
+	assert.Eventually(t, func() bool {
+		link, err := s.GetLinkByID(ctx, "a")
+		return err == nil && link.ID == ""
+	}, time.Second, 10*time.Millisecond)
+
+	URL, err := s.GetURLByID(ctx, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.org/b", URL)
+}
+
+func TestDisabledSweeperStops(t *testing.T) {
+	sw := Start(storage.NewMemoryStorage(), 0, time.Hour)
+	sw.Stop()
+	sw.Stop()
+}